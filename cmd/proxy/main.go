@@ -7,15 +7,20 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/waylen888/splitdial/internal/api"
+	"github.com/waylen888/splitdial/internal/auth"
 	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/geoip"
 	"github.com/waylen888/splitdial/internal/logging"
 	"github.com/waylen888/splitdial/internal/network"
 	"github.com/waylen888/splitdial/internal/proxy"
 	"github.com/waylen888/splitdial/internal/router"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // findConfigFile searches for the config file in multiple locations.
@@ -58,10 +63,204 @@ func findConfigFile(specifiedPath string) string {
 	return specifiedPath
 }
 
+// resolveInterfaces resolves every configured interface spec to its device.
+func resolveInterfaces(resolver *network.InterfaceResolver, specs config.InterfaceConfig) map[string]network.Uplink {
+	uplinks := make(map[string]network.Uplink, len(specs))
+	for _, name := range specs.Names() {
+		spec := specs[name]
+		// The conventional cable/wifi names fall back to auto-detection
+		if spec.Detect == "" {
+			spec.Detect = legacyDetectKind(name)
+		}
+		device, err := resolver.ResolveDeviceName(spec)
+		if err != nil {
+			logging.Warn("Could not resolve interface", "name", name, "spec", spec, "error", err)
+		}
+		uplinks[name] = network.Uplink{Device: device, Bind: spec.BindMode(), DNS: spec.DNSServers()}
+	}
+	return uplinks
+}
+
+// legacyDetectKind returns the auto-detection kind implied by the "cable"
+// and "wifi" uplink names, or "" for any other name.
+func legacyDetectKind(name string) string {
+	switch name {
+	case "cable":
+		return config.DetectWired
+	case "wifi":
+		return config.DetectWireless
+	}
+	return ""
+}
+
+// logCandidates prints the ranked interface candidates with the reasons
+// for their classification.
+func logCandidates() {
+	candidates, err := network.DetectInterfaces()
+	if err != nil {
+		logging.Warn("Interface detection failed", "error", err)
+		return
+	}
+	for i, c := range candidates {
+		logging.Info("Interface candidate",
+			"rank", i+1,
+			"device", c.Name,
+			"kind", c.Kind,
+			"score", c.Score,
+			"reasons", strings.Join(c.Reasons, "; "),
+		)
+	}
+}
+
+// logInterfaces prints each configured interface with its resolved device and IP,
+// and checks that device binding is permitted where it is requested.
+func logInterfaces(im *network.InterfaceManager, specs config.InterfaceConfig) {
+	devices := im.Devices()
+	for _, name := range specs.Names() {
+		device := devices[name]
+		if bind := specs[name].BindMode(); bind != config.BindIP && device != "" {
+			if err := network.CheckDeviceBinding(device); err != nil {
+				logging.Error("Device binding unavailable", "name", name, "device", device, "bind", bind, "error", err)
+			}
+		}
+		if addr, err := im.GetLocalAddr(name); err == nil {
+			logging.Info("Interface ready", "name", name, "spec", specs[name], "device", device, "ip", addr.IP.String())
+		} else {
+			logging.Warn("Interface error", "name", name, "spec", specs[name], "device", device, "error", err)
+		}
+	}
+}
+
+// loadGeoIP loads the GeoIP databases of the configuration, logging the
+// result. Databases that fail to load keep their previous version.
+func loadGeoIP(db *geoip.Databases, cm *config.ConfigManager, cfg config.GeoIPConfig) {
+	countryPath, asnPath := cm.ResolvePath(cfg.Database), cm.ResolvePath(cfg.ASNDatabase)
+	if err := db.Load(countryPath, asnPath); err != nil {
+		logging.Error("Failed to load GeoIP database", "error", err)
+		return
+	}
+	if countryPath != "" || asnPath != "" {
+		logging.Info("GeoIP databases loaded", "country", countryPath, "asn", asnPath)
+	}
+}
+
+// ruleSetReloader returns the function the rule-set updater calls after a
+// download: it reloads the changed cache files and swaps them into the router.
+func ruleSetReloader(cm *config.ConfigManager, r *router.Router) func() {
+	return func() {
+		if len(cm.ReloadRuleSets()) > 0 {
+			logRuleSets(cm.RuleSets())
+			r.SetRuleSets(cm.RuleSets())
+		}
+	}
+}
+
+// logRuleSets logs the entry counts and errors of the loaded rule sets.
+func logRuleSets(sets map[string]*config.RuleSet) {
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rs := sets[name]
+		if rs.Error != "" {
+			logging.Error("Failed to load rule set", "name", name, "path", rs.Path, "error", rs.Error)
+			continue
+		}
+		if rs.InvalidLines > 0 {
+			logging.Warn("Rule set has invalid lines", "name", name, "path", rs.Path, "count", rs.InvalidLines, "errors", rs.Errors)
+		}
+		logging.Info("Rule set loaded", "name", name, "format", rs.Format, "domains", len(rs.Domains), "ips", len(rs.IPs))
+	}
+}
+
+// watchInterfaces logs interface events and re-resolves the configured
+// interface specs when links change, so uplinks follow devices that come
+// and go (e.g., a USB adapter getting a new name after reconnecting).
+func watchInterfaces(ctx context.Context, watcher *network.InterfaceWatcher, resolver *network.InterfaceResolver,
+	cm *config.ConfigManager, im *network.InterfaceManager, hc *network.HealthChecker) {
+	events, cancel := watcher.Subscribe()
+	defer cancel()
+
+	logEvent := func(ev network.InterfaceEvent) bool {
+		if ev.Type == network.EventUplinkChanged {
+			// Published below; nothing to re-resolve
+			return false
+		}
+		logging.Info("Interface event", "type", ev.Type, "device", ev.Device, "uplink", ev.Uplink, "addrs", ev.Addrs)
+		return true
+	}
+
+	for {
+		var changed bool
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			changed = logEvent(ev)
+		}
+
+		// Drain the rest of a burst before re-resolving once
+	drain:
+		for {
+			select {
+			case ev := <-events:
+				changed = logEvent(ev) || changed
+			default:
+				break drain
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		resolver.Invalidate()
+		prev := im.Devices()
+		uplinks := resolveInterfaces(resolver, cm.Get().Interfaces)
+		im.SetUplinks(uplinks)
+
+		for _, name := range cm.Get().Interfaces.Names() {
+			if device := uplinks[name].Device; device != prev[name] {
+				logging.Info("Interface re-resolved", "name", name, "old_device", prev[name], "device", device)
+				watcher.Publish(network.InterfaceEvent{Type: network.EventUplinkChanged, Device: device, Uplink: name})
+			}
+		}
+		hc.Recheck()
+	}
+}
+
 func main() {
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
+	hashPassword := flag.String("hash-password", "", "Print the bcrypt hash of a password for the users section and exit")
+	printFirewall := flag.String("print-firewall", "", "Print the firewall rules for transparent proxying (nftables or iptables) and exit")
 	flag.Parse()
 
+	if *hashPassword != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(*hashPassword), bcrypt.DefaultCost)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to hash password: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
+	if *printFirewall != "" {
+		configManager := config.NewConfigManager(findConfigFile(*configPath))
+		if err := configManager.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+		rules, err := proxy.FirewallRules(*printFirewall, configManager.Get().Server)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate firewall rules: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(rules)
+		return
+	}
+
 	// Find and load configuration (before logging init, use fmt)
 	resolvedConfigPath := findConfigFile(*configPath)
 	fmt.Printf("=== Splitdial Proxy Starting ===\n")
@@ -100,48 +299,16 @@ func main() {
 	logging.Info("Logging initialized", "level", cfg.Logging.Level, "format", cfg.Logging.Format, "output", cfg.Logging.Output)
 
 	// Resolve interface specifications to device names
+	logCandidates()
 	resolver := network.NewInterfaceResolver()
-
-	cableDevice, err := resolver.ResolveDeviceName(cfg.Interfaces.Cable)
-	if err != nil {
-		logging.Warn("Could not resolve cable interface", "spec", cfg.Interfaces.Cable, "error", err)
-		// Try auto-detection as fallback
-		if detected, _, detectErr := network.DetectInterfaces(); detectErr == nil && detected != "" {
-			cableDevice = detected
-			logging.Info("Auto-detected cable interface", "device", cableDevice)
-		}
-	}
-
-	wifiDevice, err := resolver.ResolveDeviceName(cfg.Interfaces.WiFi)
-	if err != nil {
-		logging.Warn("Could not resolve wifi interface", "spec", cfg.Interfaces.WiFi, "error", err)
-		// Try auto-detection as fallback
-		if _, detected, detectErr := network.DetectInterfaces(); detectErr == nil && detected != "" {
-			wifiDevice = detected
-			logging.Info("Auto-detected wifi interface", "device", wifiDevice)
-		}
-	}
-
-	// Print interface configuration
-	logging.Info("Interface configuration",
-		"cable_spec", cfg.Interfaces.Cable,
-		"cable_device", cableDevice,
-		"wifi_spec", cfg.Interfaces.WiFi,
-		"wifi_device", wifiDevice,
-	)
+	uplinks := resolveInterfaces(resolver, cfg.Interfaces)
 
 	// Print interface IP addresses for verification
-	im := network.NewInterfaceManager(cableDevice, wifiDevice)
-	if cableAddr, err := im.GetLocalAddr("cable"); err == nil {
-		logging.Info("Cable interface ready", "device", cableDevice, "ip", cableAddr.IP.String())
-	} else {
-		logging.Warn("Cable interface error", "device", cableDevice, "error", err)
-	}
-	if wifiAddr, err := im.GetLocalAddr("wifi"); err == nil {
-		logging.Info("Wi-Fi interface ready", "device", wifiDevice, "ip", wifiAddr.IP.String())
-	} else {
-		logging.Warn("Wi-Fi interface error", "device", wifiDevice, "error", err)
-	}
+	interfaceWatcher := network.NewInterfaceWatcher(5 * time.Second)
+	interfaceManager := network.NewInterfaceManager(uplinks)
+	interfaceManager.SetWatcher(interfaceWatcher)
+	interfaceWatcher.SetUplinkLookup(interfaceManager.UplinkForDevice)
+	logInterfaces(interfaceManager, cfg.Interfaces)
 
 	// Print routing rules
 	logging.Info("Routing rules loaded", "count", len(cfg.Routes))
@@ -150,21 +317,62 @@ func main() {
 			"id", rule.ID,
 			"name", rule.Name,
 			"interface", rule.Interface,
+			"interfaces", rule.Interfaces,
+			"strategy", rule.Strategy,
 			"enabled", rule.Enabled,
 		)
 	}
 
 	// Initialize components
-	interfaceManager := network.NewInterfaceManager(cableDevice, wifiDevice)
 	interfaceDialer := network.NewInterfaceDialer(interfaceManager, 30*time.Second)
-	routerEngine := router.NewRouter(cfg.Routes)
+	interfaceDialer.SetMark(cfg.Server.RoutingMark)
+	healthChecker := network.NewHealthChecker(interfaceDialer)
+	healthChecker.Configure(cfg.HealthCheck, cfg.Interfaces)
+	routerEngine := router.NewRouter(cfg.Routes, cfg.DefaultInterfaceName())
+	logRuleSets(configManager.RuleSets())
+	routerEngine.SetRuleSets(configManager.RuleSets())
+	ruleSetUpdater := network.NewRuleSetUpdater(interfaceDialer)
+	ruleSetUpdater.Configure(configManager.RemoteRuleSets())
+	ruleSetUpdater.SetOnUpdate(ruleSetReloader(configManager, routerEngine))
+	routerEngine.SetInterfaceDownPolicy(cfg.OnInterfaceDown)
+	routerEngine.SetSniff(cfg.Sniff)
+	routerEngine.SetResolve(cfg.Resolve)
+	routerEngine.SetResolver(interfaceDialer)
+	routerEngine.SetHealthSource(healthChecker)
+	geoDB := geoip.NewDatabases()
+	loadGeoIP(geoDB, configManager, cfg.GeoIP)
+	routerEngine.SetGeoIP(geoDB)
+	users := auth.NewUsers(cfg.Users)
+
+	// Create proxy servers
+	socks5Server := proxy.NewSOCKS5Server(cfg.Server.SOCKSAddr, routerEngine, interfaceDialer, users)
+	httpProxy := proxy.NewHTTPProxyServer(cfg.Server.HTTPAddr, routerEngine, interfaceDialer, users)
+	httpProxy.SetVia(cfg.Server.HTTPVia)
+	apiServer := api.NewServer(cfg.Server.APIAddr, configManager, interfaceManager, healthChecker, interfaceWatcher, ruleSetUpdater, routerEngine)
 
 	// Start watching config for changes
 	if err := configManager.WatchConfig(func(newCfg *config.Config) {
 		logging.Info("Applying new configuration...")
 
+		interfaceDialer.SetMark(newCfg.Server.RoutingMark)
+
+		// Re-resolve interfaces in case they were added or changed
+		interfaceManager.SetUplinks(resolveInterfaces(resolver, newCfg.Interfaces))
+		logInterfaces(interfaceManager, newCfg.Interfaces)
+		healthChecker.Configure(newCfg.HealthCheck, newCfg.Interfaces)
+
 		// Update router rules
+		logRuleSets(configManager.RuleSets())
 		routerEngine.UpdateRules(newCfg.Routes)
+		routerEngine.SetRuleSets(configManager.RuleSets())
+		ruleSetUpdater.Configure(configManager.RemoteRuleSets())
+		loadGeoIP(geoDB, configManager, newCfg.GeoIP)
+		routerEngine.SetDefaultInterface(newCfg.DefaultInterfaceName())
+		routerEngine.SetInterfaceDownPolicy(newCfg.OnInterfaceDown)
+		routerEngine.SetSniff(newCfg.Sniff)
+		routerEngine.SetResolve(newCfg.Resolve)
+		users.Update(newCfg.Users)
+		httpProxy.SetVia(newCfg.Server.HTTPVia)
 
 		// Update logging level
 		logging.SetLevel(newCfg.Logging.Level)
@@ -177,11 +385,6 @@ func main() {
 		logging.Warn("Failed to start config watcher", "error", err)
 	}
 
-	// Create proxy servers
-	socks5Server := proxy.NewSOCKS5Server(cfg.Server.SOCKSAddr, routerEngine, interfaceDialer)
-	httpProxy := proxy.NewHTTPProxyServer(cfg.Server.HTTPAddr, routerEngine, interfaceDialer)
-	apiServer := api.NewServer(cfg.Server.APIAddr, configManager, interfaceManager, routerEngine)
-
 	// Setup context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -196,8 +399,18 @@ func main() {
 		cancel()
 	}()
 
+	// Start probing interfaces (idles while health checking is disabled)
+	go healthChecker.Start(ctx)
+
+	// Download remote rule sets (idles without any)
+	go ruleSetUpdater.Start(ctx)
+
+	// Follow link and address changes
+	go interfaceWatcher.Start(ctx)
+	go watchInterfaces(ctx, interfaceWatcher, resolver, configManager, interfaceManager, healthChecker)
+
 	// Start servers
-	errChan := make(chan error, 3)
+	errChan := make(chan error, 6)
 
 	go func() {
 		if err := socks5Server.Start(ctx); err != nil {
@@ -217,9 +430,47 @@ func main() {
 		}
 	}()
 
+	if cfg.Server.MixedAddr != "" {
+		mixedServer := proxy.NewMixedServer(cfg.Server.MixedAddr, socks5Server, httpProxy)
+		go func() {
+			if err := mixedServer.Start(ctx); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
+	transparent := map[string]string{
+		proxy.TransparentRedirect: cfg.Server.RedirAddr,
+		proxy.TransparentTProxy:   cfg.Server.TProxyAddr,
+	}
+	for mode, addr := range transparent {
+		if addr == "" {
+			continue
+		}
+		transparentServer := proxy.NewTransparentServer(addr, mode, routerEngine, interfaceDialer)
+		go func() {
+			if err := transparentServer.Start(ctx); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
+	if cfg.Server.TUN.Name != "" {
+		tunServer := proxy.NewTUNServer(cfg.Server.TUN, routerEngine, interfaceDialer)
+		go func() {
+			if err := tunServer.Start(ctx); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
 	logging.Info("Proxy server started successfully!",
 		"socks5", cfg.Server.SOCKSAddr,
 		"http", cfg.Server.HTTPAddr,
+		"mixed", cfg.Server.MixedAddr,
+		"redir", cfg.Server.RedirAddr,
+		"tproxy", cfg.Server.TProxyAddr,
+		"tun", cfg.Server.TUN.Name,
 		"api", cfg.Server.APIAddr,
 	)
 
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+// TestRuleSetHotSwap checks that a downloaded rule set reaches the router
+// without a restart.
+func TestRuleSetHotSwap(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "*.example.com")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	cfgYAML := fmt.Sprintf(`interfaces:
+  cable: {device: eth0}
+  wifi: {device: wlan0}
+default_interface: cable
+rule_sets:
+  remote:
+    url: %s
+routes:
+  - id: remote
+    interface: wifi
+    enabled: true
+    match:
+      rule_sets: [remote]
+`, srv.URL)
+	if err := os.WriteFile(path, []byte(cfgYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cm := config.NewConfigManager(path)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter(cm.Get().Routes, cm.Get().DefaultInterfaceName())
+	r.SetRuleSets(cm.RuleSets())
+	req := router.Request{Host: "www.example.com", Port: 443}
+	if got := r.Route(req).Interface; got != "cable" {
+		t.Fatalf("before download: routed via %s, want cable", got)
+	}
+
+	u := network.NewRuleSetUpdater(network.NewInterfaceDialer(nil, 0))
+	u.SetOnUpdate(ruleSetReloader(cm, r))
+	u.Configure(cm.RemoteRuleSets())
+	go u.Start(t.Context())
+
+	for deadline := time.Now().Add(5 * time.Second); r.Route(req).Interface != "wifi"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("after download: routed via %s, want wifi; status %+v", r.Route(req).Interface, u.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
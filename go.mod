@@ -1,12 +1,20 @@
 module github.com/waylen888/splitdial
 
-go 1.25.3
+go 1.26.3
 
 require gopkg.in/yaml.v3 v3.0.1
 
 require (
 	github.com/fsnotify/fsnotify v1.9.0
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/crypto v0.54.0
+	golang.org/x/sys v0.47.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gvisor.dev/gvisor v0.0.0-20260527191743-a81fd9dd382e
 )
 
-require golang.org/x/sys v0.13.0 // indirect
+require (
+	github.com/google/btree v1.1.2 // indirect
+	golang.org/x/exp v0.0.0-20250711185948-6ae5c78190dc // indirect
+	golang.org/x/time v0.15.0 // indirect
+)
@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/waylen888/splitdial/internal/config"
@@ -16,16 +18,22 @@ type Server struct {
 	addr             string
 	configManager    *config.ConfigManager
 	interfaceManager *network.InterfaceManager
+	healthChecker    *network.HealthChecker
+	watcher          *network.InterfaceWatcher
+	ruleSetUpdater   *network.RuleSetUpdater
 	router           *router.Router
 	mux              *http.ServeMux
 }
 
 // NewServer creates a new API server.
-func NewServer(addr string, cm *config.ConfigManager, im *network.InterfaceManager, r *router.Router) *Server {
+func NewServer(addr string, cm *config.ConfigManager, im *network.InterfaceManager, hc *network.HealthChecker, w *network.InterfaceWatcher, u *network.RuleSetUpdater, r *router.Router) *Server {
 	s := &Server{
 		addr:             addr,
 		configManager:    cm,
 		interfaceManager: im,
+		healthChecker:    hc,
+		watcher:          w,
+		ruleSetUpdater:   u,
 		router:           r,
 		mux:              http.NewServeMux(),
 	}
@@ -37,8 +45,13 @@ func NewServer(addr string, cm *config.ConfigManager, im *network.InterfaceManag
 func (s *Server) setupRoutes() {
 	// API endpoints
 	s.mux.HandleFunc("/api/interfaces", s.corsMiddleware(s.handleInterfaces))
+	s.mux.HandleFunc("/api/interfaces/candidates", s.corsMiddleware(s.handleCandidates))
 	s.mux.HandleFunc("/api/rules", s.corsMiddleware(s.handleRules))
 	s.mux.HandleFunc("/api/rules/", s.corsMiddleware(s.handleRuleByID))
+	s.mux.HandleFunc("/api/balancers", s.corsMiddleware(s.handleBalancers))
+	s.mux.HandleFunc("/api/rulesets", s.corsMiddleware(s.handleRuleSets))
+	s.mux.HandleFunc("/api/events", s.corsMiddleware(s.handleEvents))
+	s.mux.HandleFunc("/api/health", s.corsMiddleware(s.handleHealth))
 	s.mux.HandleFunc("/api/status", s.corsMiddleware(s.handleStatus))
 	s.mux.HandleFunc("/api/config", s.corsMiddleware(s.handleConfig))
 }
@@ -75,6 +88,137 @@ func (s *Server) handleInterfaces(w http.ResponseWriter, r *http.Request) {
 	s.jsonResponse(w, interfaces)
 }
 
+// handleBalancers returns per-interface stats for load-balanced rules.
+func (s *Server) handleBalancers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := s.router.BalancerStats()
+	if stats == nil {
+		stats = []router.BalancerStats{}
+	}
+	s.jsonResponse(w, stats)
+}
+
+// handleRuleSets returns the entry counts and load errors of each rule set,
+// and the download state of remote ones.
+func (s *Server) handleRuleSets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sets := s.configManager.RuleSets()
+	downloads := s.ruleSetUpdater.Status()
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		rs := sets[name]
+		errors := rs.Errors
+		if errors == nil {
+			errors = []string{}
+		}
+		status := map[string]interface{}{
+			"name":          name,
+			"path":          rs.Path,
+			"format":        rs.Format,
+			"domains":       len(rs.Domains),
+			"ips":           len(rs.IPs),
+			"invalid_lines": rs.InvalidLines,
+			"errors":        errors,
+			"error":         rs.Error,
+		}
+		if !rs.LoadedAt.IsZero() {
+			status["loaded_at"] = rs.LoadedAt
+		}
+		if download, ok := downloads[name]; ok {
+			status["url"] = rs.URL
+			status["download"] = download
+		}
+		result = append(result, status)
+	}
+	s.jsonResponse(w, result)
+}
+
+// handleEvents streams interface events as Server-Sent Events.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := s.watcher.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// handleHealth returns the health check state of each interface.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := map[string]interface{}{
+		"enabled":    s.healthChecker.Enabled(),
+		"interfaces": s.healthChecker.Status(),
+	}
+
+	s.jsonResponse(w, health)
+}
+
+// handleCandidates returns all interfaces classified by link type and
+// ranked for use as uplinks, with the reasons for each ranking.
+func (s *Server) handleCandidates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	candidates, err := network.DetectInterfaces()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.jsonResponse(w, candidates)
+}
+
 // handleRules handles CRUD operations for routing rules.
 func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -94,7 +238,10 @@ func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		s.configManager.AddRoute(rule)
+		if err := s.configManager.AddRoute(rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		s.updateRouter()
 
 		if err := s.configManager.Save(); err != nil {
@@ -153,11 +300,15 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 	cfg := s.configManager.Get()
 	status := map[string]interface{}{
-		"running":    true,
-		"socks_addr": cfg.Server.SOCKSAddr,
-		"http_addr":  cfg.Server.HTTPAddr,
-		"api_addr":   cfg.Server.APIAddr,
-		"rules":      len(cfg.Routes),
+		"running":     true,
+		"socks_addr":  cfg.Server.SOCKSAddr,
+		"http_addr":   cfg.Server.HTTPAddr,
+		"api_addr":    cfg.Server.APIAddr,
+		"mixed_addr":  cfg.Server.MixedAddr,
+		"redir_addr":  cfg.Server.RedirAddr,
+		"tproxy_addr": cfg.Server.TProxyAddr,
+		"rules":       len(cfg.Routes),
+		"interfaces":  s.interfaceManager.Devices(),
 	}
 
 	s.jsonResponse(w, status)
@@ -177,7 +328,12 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		s.configManager.UpdateRoutes(cfg.Routes)
+		// Validated with the rest of the current configuration, so cross-rule
+		// problems such as duplicate IDs are caught too
+		if err := s.configManager.UpdateRoutes(cfg.Routes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		s.updateRouter()
 
 		if err := s.configManager.Save(); err != nil {
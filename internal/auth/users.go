@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so that a failed login
+// takes as long whether or not the user exists. It is generated on first
+// use rather than at startup, since bcrypt is slow by design.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("splitdial"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Users holds the configured proxy users.
+type Users struct {
+	mu       sync.RWMutex
+	hashes   map[string][]byte   // user name -> bcrypt hash
+	verified map[string][32]byte // user name -> SHA-256 of the last password that matched
+}
+
+// NewUsers creates a user store from the configured users.
+func NewUsers(users []config.UserConfig) *Users {
+	u := &Users{}
+	u.Update(users)
+	return u
+}
+
+// Update replaces the configured users, e.g. after a config reload.
+func (u *Users) Update(users []config.UserConfig) {
+	hashes := make(map[string][]byte, len(users))
+	for _, user := range users {
+		hashes[user.Name] = []byte(user.Password)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hashes = hashes
+	u.verified = make(map[string][32]byte)
+}
+
+// Enabled reports whether any users are configured, in which case clients
+// must authenticate.
+func (u *Users) Enabled() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.hashes) > 0
+}
+
+// Verify reports whether password is correct for the user. bcrypt is slow
+// by design, so a successful password is remembered (as a SHA-256 digest)
+// and later logins with it skip the bcrypt comparison.
+func (u *Users) Verify(name, password string) bool {
+	digest := sha256.Sum256([]byte(password))
+
+	u.mu.RLock()
+	hash, ok := u.hashes[name]
+	last, cached := u.verified[name]
+	u.mu.RUnlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	if cached && subtle.ConstantTimeCompare(last[:], digest[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	if string(u.hashes[name]) == string(hash) { // not replaced by a reload meanwhile
+		u.verified[name] = digest
+	}
+	u.mu.Unlock()
+	return true
+}
@@ -1,22 +1,110 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/waylen888/splitdial/internal/logging"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds all configuration for the proxy server.
 type Config struct {
-	Server     ServerConfig    `yaml:"server"`
-	Routes     []RouteRule     `yaml:"routes"`
-	Interfaces InterfaceConfig `yaml:"interfaces"`
-	Logging    LoggingConfig   `yaml:"logging"`
+	Server           ServerConfig             `yaml:"server"`
+	Routes           []RouteRule              `yaml:"routes"`
+	Interfaces       InterfaceConfig          `yaml:"interfaces"`
+	DefaultInterface string                   `yaml:"default_interface,omitempty"` // used when no rule matches
+	OnInterfaceDown  string                   `yaml:"on_interface_down,omitempty"` // default policy, see PolicyFallbackDefault
+	HealthCheck      HealthCheckConfig        `yaml:"health_check"`
+	Sniff            SniffConfig              `yaml:"sniff"`
+	Resolve          ResolveConfig            `yaml:"resolve,omitempty"`   // lookups for routes with resolve set
+	RuleSets         map[string]RuleSetConfig `yaml:"rule_sets,omitempty"` // referenced by Match.RuleSets
+	GeoIP            GeoIPConfig              `yaml:"geoip,omitempty"`     // databases for Match.GeoIP and Match.ASN
+	Users            []UserConfig             `yaml:"users,omitempty"`     // when set, proxy clients must authenticate
+	Logging          LoggingConfig            `yaml:"logging"`
+}
+
+// HealthCheckConfig configures background probing of each interface.
+type HealthCheckConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Interval      time.Duration `yaml:"interval,omitempty"`       // time between probe rounds (default 30s)
+	Timeout       time.Duration `yaml:"timeout,omitempty"`        // per-probe timeout (default 5s)
+	Targets       []string      `yaml:"targets,omitempty"`        // e.g., ["tcp://1.1.1.1:443", "http://connectivitycheck.gstatic.com/generate_204"]
+	FailThreshold int           `yaml:"fail_threshold,omitempty"` // consecutive failures before unhealthy (default 3)
+	RiseThreshold int           `yaml:"rise_threshold,omitempty"` // consecutive successes before healthy (default 1)
+}
+
+// SniffConfig configures reading the server name (TLS SNI, HTTP Host, QUIC
+// SNI) from connections requested by IP address, so domain rules can match.
+type SniffConfig struct {
+	Enabled bool          `yaml:"enabled"`           // default for rules without their own sniff setting
+	Timeout time.Duration `yaml:"timeout,omitempty"` // how long to wait for the client's first bytes (default DefaultSniffTimeout)
+}
+
+// DefaultSniffTimeout bounds the wait for a client's first bytes. Protocols
+// where the server speaks first are relayed unsniffed after it.
+const DefaultSniffTimeout = 300 * time.Millisecond
+
+// SniffTimeout returns the sniffing timeout, or DefaultSniffTimeout if unset.
+func (s SniffConfig) SniffTimeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultSniffTimeout
+}
+
+// ResolveConfig configures the DNS lookups of routes with resolve set, which
+// match their IP conditions against the addresses a domain resolves to.
+type ResolveConfig struct {
+	Timeout  time.Duration `yaml:"timeout,omitempty"`   // per lookup (default DefaultResolveTimeout)
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"` // how long answers are reused (default DefaultResolveCacheTTL)
+}
+
+const (
+	DefaultResolveTimeout  = 2 * time.Second
+	DefaultResolveCacheTTL = 5 * time.Minute
+)
+
+// ResolveTimeout returns the lookup timeout, or DefaultResolveTimeout if unset.
+func (r ResolveConfig) ResolveTimeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultResolveTimeout
+}
+
+// ResolveCacheTTL returns how long answers are cached, or
+// DefaultResolveCacheTTL if unset.
+func (r ResolveConfig) ResolveCacheTTL() time.Duration {
+	if r.CacheTTL > 0 {
+		return r.CacheTTL
+	}
+	return DefaultResolveCacheTTL
+}
+
+// GeoIPConfig locates the MaxMind databases (MMDB) used by Match.GeoIP and
+// Match.ASN, e.g. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb. Relative
+// paths are resolved against the config file's directory.
+type GeoIPConfig struct {
+	Database    string `yaml:"database,omitempty"`     // country (or city) database
+	ASNDatabase string `yaml:"asn_database,omitempty"` // autonomous system database
+}
+
+// UserConfig defines a proxy user. The password hash is never encoded as
+// JSON, so the API can't hand it out for offline cracking.
+type UserConfig struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password" json:"-"` // bcrypt hash, e.g. from `htpasswd -nbB user secret`
 }
 
 // LoggingConfig holds logging configuration.
@@ -32,44 +120,233 @@ type LoggingConfig struct {
 
 // ServerConfig holds server-related configuration.
 type ServerConfig struct {
-	SOCKSAddr string `yaml:"socks_addr"` // e.g., "127.0.0.1:1080"
-	HTTPAddr  string `yaml:"http_addr"`  // e.g., "127.0.0.1:8080"
-	APIAddr   string `yaml:"api_addr"`   // e.g., "127.0.0.1:8081"
+	SOCKSAddr string `yaml:"socks_addr"`           // e.g., "127.0.0.1:1080"
+	HTTPAddr  string `yaml:"http_addr"`            // e.g., "127.0.0.1:8080"
+	APIAddr   string `yaml:"api_addr"`             // e.g., "127.0.0.1:8081"
+	MixedAddr string `yaml:"mixed_addr,omitempty"` // optional port accepting both SOCKS and HTTP, e.g., "127.0.0.1:7890"
+	HTTPVia   string `yaml:"http_via,omitempty"`   // pseudonym for the Via header of forwarded HTTP requests, e.g., "splitdial"; empty omits it
+
+	// Transparent proxying (Linux). Print matching firewall rules with
+	// -print-firewall.
+	RedirAddr   string `yaml:"redir_addr,omitempty"`   // listener for connections redirected with iptables/nftables REDIRECT
+	TProxyAddr  string `yaml:"tproxy_addr,omitempty"`  // listener for connections diverted with TPROXY
+	RoutingMark int    `yaml:"routing_mark,omitempty"` // SO_MARK for the proxy's own outbound sockets, so firewall rules can skip them
+
+	TUN TUNConfig `yaml:"tun,omitempty"` // capture traffic routed into a TUN device (Linux)
+}
+
+// TUNConfig defines the TUN device whose traffic a userspace TCP/IP stack
+// terminates and routes like SOCKS5 requests. Addresses and routes pointing
+// into the device are left to the system configuration.
+type TUNConfig struct {
+	Name string `yaml:"name,omitempty"` // device name, e.g. "splitdial0"; created if missing, empty disables TUN mode
+	MTU  int    `yaml:"mtu,omitempty"`  // default DefaultTUNMTU
 }
 
+// DefaultTUNMTU is the MTU of the TUN device if TUNConfig.MTU is unset.
+const DefaultTUNMTU = 1500
+
+// DeviceMTU returns the configured MTU, or DefaultTUNMTU if unset.
+func (t TUNConfig) DeviceMTU() int {
+	if t.MTU == 0 {
+		return DefaultTUNMTU
+	}
+	return t.MTU
+}
+
+// TProxyMark is the firewall mark used by the printed TPROXY rules to route
+// diverted packets to the local TPROXY listener. It must differ from
+// ServerConfig.RoutingMark.
+const TProxyMark = 1
+
+// Link kinds for InterfaceSpec.Detect.
+const (
+	DetectWired    = "wired"
+	DetectWireless = "wireless"
+	DetectCellular = "cellular"
+)
+
+// Bind modes for InterfaceSpec.Bind.
+const (
+	BindIP     = "ip"     // bind the socket to the interface's local address
+	BindDevice = "device" // bind the socket to the device (SO_BINDTODEVICE, Linux only)
+	BindBoth   = "both"   // bind to both the local address and the device
+)
+
 // InterfaceSpec defines how to identify a network interface.
+// Device and HardwarePort name the interface directly. Otherwise the
+// selectors (MAC, Driver, BusPath, PathName, Name) are combined, and the
+// interface must match all of the ones that are set.
 type InterfaceSpec struct {
-	Device       string `yaml:"device,omitempty"`        // Direct device name (e.g., "en7")
-	HardwarePort string `yaml:"hardware_port,omitempty"` // macOS Hardware Port name (e.g., "Wi-Fi")
+	Device        string   `yaml:"device,omitempty"`         // Direct device name (e.g., "en7")
+	HardwarePort  string   `yaml:"hardware_port,omitempty"`  // macOS Hardware Port name (e.g., "Wi-Fi")
+	MAC           string   `yaml:"mac,omitempty"`            // MAC address (e.g., "00:14:3d:28:0b:ad")
+	Driver        string   `yaml:"driver,omitempty"`         // Linux sysfs driver name (e.g., "r8152")
+	BusPath       string   `yaml:"bus_path,omitempty"`       // Linux sysfs device path under /sys/devices, glob or suffix (e.g., "*/usb2/2-1/*")
+	PathName      string   `yaml:"path_name,omitempty"`      // Linux udev ID_NET_NAME_PATH (e.g., "enp0s20f0u1")
+	Name          string   `yaml:"name,omitempty"`           // device name glob (e.g., "wwan*")
+	Detect        string   `yaml:"detect,omitempty"`         // auto-detect by link kind if the above fail: "wired", "wireless" or "cellular"
+	Bind          string   `yaml:"bind,omitempty"`           // "ip" (default), "device" or "both"
+	HealthTargets []string `yaml:"health_targets,omitempty"` // overrides health_check.targets for this interface
+	DNS           []string `yaml:"dns,omitempty"`            // nameservers queried through this interface (e.g., "1.1.1.1", "[2606:4700::1111]:53")
 }
 
-// InterfaceConfig holds network interface configuration.
-type InterfaceConfig struct {
-	Cable InterfaceSpec `yaml:"cable"`
-	WiFi  InterfaceSpec `yaml:"wifi"`
+// DNSServers returns the interface's nameservers as host:port addresses,
+// defaulting the port to 53. Invalid entries are skipped.
+func (s InterfaceSpec) DNSServers() []string {
+	var servers []string
+	for _, server := range s.DNS {
+		if addr, err := ParseDNSServer(server); err == nil {
+			servers = append(servers, addr)
+		}
+	}
+	return servers
+}
+
+// ParseDNSServer parses a nameserver given as an IP address with an
+// optional port and returns it as host:port.
+func ParseDNSServer(server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = strings.Trim(server, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid nameserver %q: must be an IP address", server)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid nameserver %q: bad port", server)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// HasSelectors reports whether any selector other than Device and
+// HardwarePort is set.
+func (s InterfaceSpec) HasSelectors() bool {
+	return s.MAC != "" || s.Driver != "" || s.BusPath != "" || s.PathName != "" || s.Name != ""
+}
+
+// BindMode returns the bind mode, defaulting to BindIP.
+func (s InterfaceSpec) BindMode() string {
+	if s.Bind == "" {
+		return BindIP
+	}
+	return s.Bind
+}
+
+// InterfaceConfig maps user-chosen uplink names (e.g., "cable", "wifi", "lte")
+// to the specs that identify their network interfaces.
+type InterfaceConfig map[string]InterfaceSpec
+
+// Names returns the configured uplink names in sorted order.
+func (ic InterfaceConfig) Names() []string {
+	names := make([]string, 0, len(ic))
+	for name := range ic {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether an uplink with the given name is configured.
+func (ic InterfaceConfig) Has(name string) bool {
+	_, ok := ic[name]
+	return ok
 }
 
 // RouteRule defines a routing rule.
 type RouteRule struct {
-	ID        string `yaml:"id"`
-	Name      string `yaml:"name"`
-	Match     Match  `yaml:"match"`
-	Interface string `yaml:"interface"` // "cable" or "wifi"
-	Enabled   bool   `yaml:"enabled"`
+	ID        string   `yaml:"id"`
+	Name      string   `yaml:"name"`
+	Match     Match    `yaml:"match"`
+	Interface string   `yaml:"interface,omitempty"` // name of an uplink in Config.Interfaces
+	Fallback  []string `yaml:"fallback,omitempty"`  // uplinks tried in order when Interface is unhealthy
+	Enabled   bool     `yaml:"enabled"`
+
+	// Interfaces, Strategy and Weights spread connections across a group of
+	// uplinks instead of using a single Interface.
+	Interfaces []string       `yaml:"interfaces,omitempty"`
+	Strategy   string         `yaml:"strategy,omitempty"` // see StrategyRoundRobin
+	Weights    map[string]int `yaml:"weights,omitempty"`  // per-interface weight for "weighted" (default 1)
+
+	// RaceDelay is the stagger between connection attempts for the "race"
+	// strategy (default DefaultRaceDelay).
+	RaceDelay time.Duration `yaml:"race_delay,omitempty"`
+
+	// OnInterfaceDown overrides Config.OnInterfaceDown for this rule.
+	OnInterfaceDown string `yaml:"on_interface_down,omitempty"`
+
+	// Sniff overrides Config.Sniff.Enabled for connections to an IP address
+	// that this rule matches; they are then routed again by the sniffed name.
+	Sniff *bool `yaml:"sniff,omitempty"`
+
+	// Resolve makes requests for a domain resolve it through the rule's
+	// interface and match the IP, GeoIP, ASN and rule-set conditions against
+	// the addresses, instead of skipping IP conditions. A matching address is
+	// then dialed directly.
+	Resolve bool `yaml:"resolve,omitempty"`
+}
+
+// Strategies for distributing a rule's connections across its Interfaces.
+const (
+	StrategyRoundRobin       = "round_robin"       // rotate through the group (default)
+	StrategyWeighted         = "weighted"          // rotate in proportion to Weights
+	StrategyLeastConnections = "least_connections" // pick the interface with fewest active connections
+	StrategyHash             = "hash"              // consistent hash of the destination host
+	StrategyRace             = "race"              // race all interfaces and IP families, keep the first to connect
+)
+
+// DefaultRaceDelay is the stagger between attempts of the "race" strategy,
+// as recommended by RFC 8305 (Happy Eyeballs v2).
+const DefaultRaceDelay = 250 * time.Millisecond
+
+// IsGroup reports whether the rule balances across a group of interfaces.
+func (r RouteRule) IsGroup() bool {
+	return len(r.Interfaces) > 0
+}
+
+// Policies for OnInterfaceDown, applied when the routed interface (and any
+// healthy fallback) is unavailable.
+const (
+	PolicyFallbackDefault = "fallback_default" // dial through the system default route
+	PolicyFallbackTo      = "fallback_to"      // dial through another interface: "fallback_to:<name>"
+	PolicyReject          = "reject"           // refuse the connection
+)
+
+// ParseInterfaceDownPolicy splits a policy into its action and, for
+// fallback_to, the target interface. An empty policy means fallback_default.
+func ParseInterfaceDownPolicy(policy string) (action, target string, err error) {
+	switch {
+	case policy == "" || policy == PolicyFallbackDefault:
+		return PolicyFallbackDefault, "", nil
+	case policy == PolicyReject:
+		return PolicyReject, "", nil
+	case strings.HasPrefix(policy, PolicyFallbackTo+":"):
+		target = strings.TrimPrefix(policy, PolicyFallbackTo+":")
+		if target == "" {
+			return "", "", fmt.Errorf("policy %q: missing interface name", policy)
+		}
+		return PolicyFallbackTo, target, nil
+	}
+	return "", "", fmt.Errorf("unknown on_interface_down policy %q", policy)
 }
 
 // Match defines conditions for a route rule.
 type Match struct {
-	Domains  []string `yaml:"domains,omitempty"`  // e.g., ["*.google.com", "example.com"]
-	IPs      []string `yaml:"ips,omitempty"`      // e.g., ["192.168.1.0/24"]
-	Ports    []int    `yaml:"ports,omitempty"`    // e.g., [80, 443]
-	Protocol string   `yaml:"protocol,omitempty"` // "tcp" or "udp"
+	Domains  []string `yaml:"domains,omitempty"`   // e.g., ["*.google.com", "example.com"]
+	IPs      []string `yaml:"ips,omitempty"`       // e.g., ["192.168.1.0/24"]
+	Ports    []int    `yaml:"ports,omitempty"`     // e.g., [80, 443]
+	Protocol string   `yaml:"protocol,omitempty"`  // "tcp" or "udp"
+	Users    []string `yaml:"users,omitempty"`     // authenticated user names, e.g., ["alice"]
+	RuleSets []string `yaml:"rule_sets,omitempty"` // names in Config.RuleSets; matches a domain or IP in any of them
+	GeoIP    []string `yaml:"geoip,omitempty"`     // ISO 3166-1 country codes of the destination IP, e.g., ["CN", "TW"]
+	ASN      []uint32 `yaml:"asn,omitempty"`       // autonomous system numbers of the destination IP, e.g., [15169]
 }
 
 // ConfigManager manages configuration with hot-reload support.
 type ConfigManager struct {
 	mu       sync.RWMutex
 	config   *Config
+	ruleSets map[string]*RuleSet
 	filePath string
 }
 
@@ -90,8 +367,17 @@ func DefaultConfig() *Config {
 			APIAddr:   "127.0.0.1:8081",
 		},
 		Interfaces: InterfaceConfig{
-			Cable: InterfaceSpec{Device: "en0"},
-			WiFi:  InterfaceSpec{Device: "en1"},
+			"cable": {Device: "en0"},
+			"wifi":  {Device: "en1"},
+		},
+		DefaultInterface: "cable",
+		HealthCheck: HealthCheckConfig{
+			Enabled:       false,
+			Interval:      30 * time.Second,
+			Timeout:       5 * time.Second,
+			Targets:       []string{"tcp://1.1.1.1:443", "tcp://8.8.8.8:443"},
+			FailThreshold: 3,
+			RiseThreshold: 1,
 		},
 		Logging: LoggingConfig{
 			Level:      "info",
@@ -133,7 +419,224 @@ func (cm *ConfigManager) Load() error {
 		return err
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
 	cm.config = &cfg
+	cm.ruleSets, _ = cm.loadRuleSets(&cfg, cm.ruleSets)
+	return nil
+}
+
+// DefaultInterfaceName returns the uplink used when no rule matches.
+// If default_interface is not set, "cable" is used when configured (matching
+// older configs), otherwise the first uplink in sorted order.
+func (c *Config) DefaultInterfaceName() string {
+	if c.DefaultInterface != "" {
+		return c.DefaultInterface
+	}
+	if c.Interfaces.Has("cable") {
+		return "cable"
+	}
+	if names := c.Interfaces.Names(); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// Validate checks that the configuration is internally consistent.
+func (c *Config) Validate() error {
+	if len(c.Interfaces) == 0 {
+		return fmt.Errorf("no interfaces configured")
+	}
+	for _, name := range c.Interfaces.Names() {
+		spec := c.Interfaces[name]
+		if spec.Device == "" && spec.HardwarePort == "" && !spec.HasSelectors() && spec.Detect == "" {
+			return fmt.Errorf("interface %q: one of device, hardware_port, mac, driver, bus_path, path_name, name or detect is required", name)
+		}
+		switch spec.Detect {
+		case "", DetectWired, DetectWireless, DetectCellular:
+		default:
+			return fmt.Errorf("interface %q: invalid detect kind %q", name, spec.Detect)
+		}
+		switch spec.BindMode() {
+		case BindIP, BindDevice, BindBoth:
+		default:
+			return fmt.Errorf("interface %q: invalid bind mode %q", name, spec.Bind)
+		}
+		for _, server := range spec.DNS {
+			if _, err := ParseDNSServer(server); err != nil {
+				return fmt.Errorf("interface %q: %w", name, err)
+			}
+		}
+	}
+	if c.Server.RoutingMark < 0 {
+		return fmt.Errorf("server: routing_mark must not be negative")
+	}
+	if c.Server.TProxyAddr != "" && c.Server.RoutingMark == TProxyMark {
+		return fmt.Errorf("server: routing_mark %d is reserved for TPROXY", TProxyMark)
+	}
+	if tun := c.Server.TUN; tun.Name != "" || tun.MTU != 0 {
+		if tun.Name == "" || len(tun.Name) >= 16 || strings.ContainsAny(tun.Name, "/ ") {
+			return fmt.Errorf("server: tun.name %q is not a valid device name", tun.Name)
+		}
+		if tun.MTU != 0 && (tun.MTU < 1280 || tun.MTU > 65535) {
+			return fmt.Errorf("server: tun.mtu must be between 1280 and 65535")
+		}
+	}
+	users := make(map[string]bool, len(c.Users))
+	for _, user := range c.Users {
+		if user.Name == "" {
+			return fmt.Errorf("users: name is required")
+		}
+		if users[user.Name] {
+			return fmt.Errorf("user %q: defined twice", user.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+			return fmt.Errorf("user %q: password must be a bcrypt hash: %w", user.Name, err)
+		}
+		users[user.Name] = true
+	}
+	if c.DefaultInterface != "" && !c.Interfaces.Has(c.DefaultInterface) {
+		return fmt.Errorf("default_interface %q is not a configured interface", c.DefaultInterface)
+	}
+	if err := c.validatePolicy(c.OnInterfaceDown); err != nil {
+		return err
+	}
+	for name, rs := range c.RuleSets {
+		if err := c.validateRuleSet(name, rs); err != nil {
+			return err
+		}
+	}
+	ids := make(map[string]bool, len(c.Routes))
+	for _, rule := range c.Routes {
+		if rule.ID == "" && rule.IsGroup() {
+			// Load-balancing state is kept per rule ID
+			return fmt.Errorf("route %q: id is required for rules with interfaces", rule.Name)
+		}
+		if rule.ID != "" && ids[rule.ID] {
+			return fmt.Errorf("route %q: defined twice", rule.ID)
+		}
+		ids[rule.ID] = true
+		if err := c.ValidateRoute(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasUser reports whether a user with the given name is configured.
+func (c *Config) HasUser(name string) bool {
+	for _, user := range c.Users {
+		if user.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoute checks that a route rule references configured interfaces.
+func (c *Config) ValidateRoute(rule RouteRule) error {
+	if rule.IsGroup() {
+		if err := c.validateGroup(rule); err != nil {
+			return err
+		}
+	} else {
+		if rule.Interface == "" {
+			return fmt.Errorf("route %q: interface or interfaces is required", rule.ID)
+		}
+		if !c.Interfaces.Has(rule.Interface) {
+			return fmt.Errorf("route %q: unknown interface %q", rule.ID, rule.Interface)
+		}
+	}
+	for _, name := range rule.Fallback {
+		if !c.Interfaces.Has(name) {
+			return fmt.Errorf("route %q: unknown fallback interface %q", rule.ID, name)
+		}
+	}
+	for _, name := range rule.Match.Users {
+		if !c.HasUser(name) {
+			return fmt.Errorf("route %q: unknown user %q", rule.ID, name)
+		}
+	}
+	for _, name := range rule.Match.RuleSets {
+		if _, ok := c.RuleSets[name]; !ok {
+			return fmt.Errorf("route %q: unknown rule set %q", rule.ID, name)
+		}
+	}
+	if len(rule.Match.GeoIP) > 0 && c.GeoIP.Database == "" {
+		return fmt.Errorf("route %q: geoip requires geoip.database", rule.ID)
+	}
+	for _, code := range rule.Match.GeoIP {
+		if len(code) != 2 || !isLetters(code) {
+			return fmt.Errorf("route %q: invalid country code %q", rule.ID, code)
+		}
+	}
+	if len(rule.Match.ASN) > 0 && c.GeoIP.ASNDatabase == "" {
+		return fmt.Errorf("route %q: asn requires geoip.asn_database", rule.ID)
+	}
+	if rule.Resolve && len(rule.Match.IPs) == 0 && len(rule.Match.GeoIP) == 0 && len(rule.Match.ASN) == 0 && len(rule.Match.RuleSets) == 0 {
+		return fmt.Errorf("route %q: resolve requires ips, geoip, asn or rule_sets conditions", rule.ID)
+	}
+	if err := c.validatePolicy(rule.OnInterfaceDown); err != nil {
+		return fmt.Errorf("route %q: %w", rule.ID, err)
+	}
+	return nil
+}
+
+// isLetters reports whether s consists of ASCII letters.
+func isLetters(s string) bool {
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateGroup checks a load-balanced rule's interfaces, strategy and weights.
+func (c *Config) validateGroup(rule RouteRule) error {
+	if rule.Interface != "" {
+		return fmt.Errorf("route %q: interface and interfaces are mutually exclusive", rule.ID)
+	}
+	members := make(map[string]bool, len(rule.Interfaces))
+	for _, name := range rule.Interfaces {
+		if !c.Interfaces.Has(name) {
+			return fmt.Errorf("route %q: unknown interface %q", rule.ID, name)
+		}
+		if members[name] {
+			return fmt.Errorf("route %q: interface %q listed twice", rule.ID, name)
+		}
+		members[name] = true
+	}
+	switch rule.Strategy {
+	case "", StrategyRoundRobin, StrategyWeighted, StrategyLeastConnections, StrategyHash, StrategyRace:
+	default:
+		return fmt.Errorf("route %q: unknown strategy %q", rule.ID, rule.Strategy)
+	}
+	if rule.RaceDelay < 0 {
+		return fmt.Errorf("route %q: race_delay must not be negative", rule.ID)
+	}
+	for name, weight := range rule.Weights {
+		if !members[name] {
+			return fmt.Errorf("route %q: weight for interface %q which is not in interfaces", rule.ID, name)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("route %q: weight for interface %q must be positive", rule.ID, name)
+		}
+	}
+	return nil
+}
+
+// validatePolicy checks an on_interface_down policy and its target interface.
+func (c *Config) validatePolicy(policy string) error {
+	action, target, err := ParseInterfaceDownPolicy(policy)
+	if err != nil {
+		return err
+	}
+	if action == PolicyFallbackTo && !c.Interfaces.Has(target) {
+		return fmt.Errorf("on_interface_down: unknown interface %q", target)
+	}
 	return nil
 }
 
@@ -160,20 +663,35 @@ func (cm *ConfigManager) Get() *Config {
 	return &cfg
 }
 
-// UpdateRoutes updates the routing rules.
-func (cm *ConfigManager) UpdateRoutes(routes []RouteRule) {
+// UpdateRoutes replaces the routing rules, unless the configuration with
+// them fails validation.
+func (cm *ConfigManager) UpdateRoutes(routes []RouteRule) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	cm.config.Routes = routes
+	return cm.setRoutes(routes)
 }
 
-// AddRoute adds a new route.
-func (cm *ConfigManager) AddRoute(route RouteRule) {
+// AddRoute adds a new route, unless the configuration with it fails
+// validation.
+func (cm *ConfigManager) AddRoute(route RouteRule) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	cm.config.Routes = append(cm.config.Routes, route)
+	routes := append(slices.Clip(cm.config.Routes), route)
+	return cm.setRoutes(routes)
+}
+
+// setRoutes validates the configuration with routes and applies it. The
+// caller must hold cm.mu.
+func (cm *ConfigManager) setRoutes(routes []RouteRule) error {
+	next := *cm.config
+	next.Routes = routes
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	cm.config.Routes = routes
+	return nil
 }
 
 // RemoveRoute removes a route by ID.
@@ -203,6 +721,7 @@ func (cm *ConfigManager) WatchConfig(onChange func(*Config)) error {
 		watcher.Close()
 		return err
 	}
+	cm.watchDataDirs(watcher)
 
 	go func() {
 		defer watcher.Close()
@@ -215,34 +734,50 @@ func (cm *ConfigManager) WatchConfig(onChange func(*Config)) error {
 					return
 				}
 
-				// Check if the event matches our config file
-				if filepath.Base(event.Name) == filepath.Base(cm.filePath) {
-					// Handle Write and Create (which happens on atomic rename/move)
-					if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-						// Simple debounce
-						if time.Since(lastReload) < 100*time.Millisecond {
-							continue
-						}
-
-						logging.Info("Configuration file changed", "op", event.Op.String())
-
-						// Slight delay to ensure write is complete
-						time.Sleep(50 * time.Millisecond)
-
-						if err := cm.Load(); err != nil {
-							logging.Error("Failed to reload configuration", "error", err)
-							continue
-						}
-
-						lastReload = time.Now()
-						logging.Info("Configuration reloaded successfully")
-
-						if onChange != nil {
-							// Execute callback in a non-blocking way or make sure it's fast
-							// Here we execute directly as it updates router/logger which is fast
-							onChange(cm.Get())
-						}
+				// Handle Write and Create (which happens on atomic rename/move)
+				if event.Op&fsnotify.Write != fsnotify.Write && event.Op&fsnotify.Create != fsnotify.Create {
+					continue
+				}
+				isConfig := filepath.Base(event.Name) == filepath.Base(cm.filePath) && filepath.Dir(event.Name) == configDir
+				isRuleSet := !isConfig && cm.isRuleSetFile(event.Name)
+				isGeoIP := !isConfig && cm.isGeoIPFile(event.Name)
+				if !isConfig && !isRuleSet && !isGeoIP {
+					continue
+				}
+
+				// Simple debounce
+				if time.Since(lastReload) < 100*time.Millisecond {
+					continue
+				}
+
+				// Slight delay to ensure write is complete
+				time.Sleep(50 * time.Millisecond)
+
+				switch {
+				case isConfig:
+					logging.Info("Configuration file changed", "op", event.Op.String())
+					if err := cm.Load(); err != nil {
+						logging.Error("Failed to reload configuration", "error", err)
+						continue
+					}
+					logging.Info("Configuration reloaded successfully")
+					// New rule sets or databases may live in other directories
+					cm.watchDataDirs(watcher)
+				case isRuleSet:
+					logging.Info("Rule set file changed", "file", event.Name, "op", event.Op.String())
+					if len(cm.ReloadRuleSets()) == 0 {
+						continue
 					}
+				default:
+					// Reloaded by onChange
+					logging.Info("GeoIP database changed", "file", event.Name, "op", event.Op.String())
+				}
+				lastReload = time.Now()
+
+				if onChange != nil {
+					// Execute callback in a non-blocking way or make sure it's fast
+					// Here we execute directly as it updates router/logger which is fast
+					onChange(cm.Get())
 				}
 
 			case err, ok := <-watcher.Errors:
@@ -256,3 +791,50 @@ func (cm *ConfigManager) WatchConfig(onChange func(*Config)) error {
 
 	return nil
 }
+
+// watchDataDirs adds the directories of the rule-set files and GeoIP
+// databases to watcher.
+func (cm *ConfigManager) watchDataDirs(watcher *fsnotify.Watcher) {
+	dirs := cm.ruleSetDirs()
+	for _, path := range cm.GeoIPPaths() {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			logging.Warn("Failed to watch data directory", "dir", dir, "error", err)
+		}
+	}
+}
+
+// GeoIPPaths returns the resolved paths of the configured GeoIP databases.
+func (cm *ConfigManager) GeoIPPaths() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var paths []string
+	for _, path := range []string{cm.config.GeoIP.Database, cm.config.GeoIP.ASNDatabase} {
+		if path != "" {
+			paths = append(paths, cm.ResolvePath(path))
+		}
+	}
+	return paths
+}
+
+// isGeoIPFile reports whether path is one of the GeoIP databases.
+func (cm *ConfigManager) isGeoIPFile(path string) bool {
+	for _, p := range cm.GeoIPPaths() {
+		if filepath.Clean(p) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvePath resolves a path from the configuration against the config
+// file's directory. Empty and absolute paths are returned as is.
+func (cm *ConfigManager) ResolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(cm.filePath), path)
+}
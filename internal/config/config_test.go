@@ -0,0 +1,140 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateRouteIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []RouteRule
+		err    string
+	}{
+		{
+			name: "unique",
+			routes: []RouteRule{
+				{ID: "a", Interface: "cable", Enabled: true},
+				{ID: "b", Interfaces: []string{"cable", "wifi"}, Enabled: true},
+			},
+		},
+		{
+			name: "duplicate",
+			routes: []RouteRule{
+				{ID: "lb", Interfaces: []string{"cable", "wifi"}, Enabled: true},
+				{ID: "lb", Interfaces: []string{"wifi"}, Enabled: true},
+			},
+			err: `route "lb": defined twice`,
+		},
+		{
+			name: "group without id",
+			routes: []RouteRule{
+				{Name: "lb", Interfaces: []string{"cable", "wifi"}, Enabled: true},
+			},
+			err: "id is required",
+		},
+		{
+			name: "single interface without id",
+			routes: []RouteRule{
+				{Interface: "cable", Enabled: true},
+				{Interface: "wifi", Enabled: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Interfaces: InterfaceConfig{
+					"cable": {Device: "eth0"},
+					"wifi":  {Device: "wlan0"},
+				},
+				Routes: tt.routes,
+			}
+			err := cfg.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("Validate() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateTUN(t *testing.T) {
+	tests := []struct {
+		name string
+		tun  TUNConfig
+		err  string
+	}{
+		{name: "disabled"},
+		{name: "default mtu", tun: TUNConfig{Name: "splitdial0"}},
+		{name: "mtu", tun: TUNConfig{Name: "splitdial0", MTU: 9000}},
+		{name: "mtu without name", tun: TUNConfig{MTU: 1500}, err: "tun.name"},
+		{name: "long name", tun: TUNConfig{Name: "splitdial-tunnel0"}, err: "tun.name"},
+		{name: "path", tun: TUNConfig{Name: "../tun0"}, err: "tun.name"},
+		{name: "small mtu", tun: TUNConfig{Name: "splitdial0", MTU: 576}, err: "tun.mtu"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Server:     ServerConfig{TUN: tt.tun},
+				Interfaces: InterfaceConfig{"cable": {Device: "eth0"}},
+			}
+			err := cfg.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("Validate() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConfigManagerRoutesValidated(t *testing.T) {
+	cm := NewConfigManager(t.TempDir() + "/config.yaml")
+	cm.config = &Config{
+		Interfaces: InterfaceConfig{"cable": {Device: "eth0"}},
+		Routes:     []RouteRule{{ID: "a", Interface: "cable", Enabled: true}},
+	}
+
+	if err := cm.AddRoute(RouteRule{ID: "a", Interface: "cable", Enabled: true}); err == nil {
+		t.Fatal("AddRoute accepted a duplicate ID")
+	}
+	if err := cm.UpdateRoutes([]RouteRule{
+		{ID: "b", Interface: "cable", Enabled: true},
+		{ID: "b", Interface: "cable", Enabled: true},
+	}); err == nil {
+		t.Fatal("UpdateRoutes accepted a duplicate ID")
+	}
+	if routes := cm.Get().Routes; len(routes) != 1 || routes[0].ID != "a" {
+		t.Fatalf("routes changed by rejected updates: %+v", routes)
+	}
+
+	if err := cm.AddRoute(RouteRule{ID: "b", Interface: "cable", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cm.Get().Routes); n != 2 {
+		t.Fatalf("routes = %d, want 2", n)
+	}
+}
+
+func TestUserPasswordNotEncodedAsJSON(t *testing.T) {
+	const hash = "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+	cfg := &Config{Users: []UserConfig{{Name: "alice", Password: hash}}}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), hash) || strings.Contains(string(data), "Password") {
+		t.Fatalf("JSON config contains the password hash: %s", data)
+	}
+	if !strings.Contains(string(data), "alice") {
+		t.Fatalf("JSON config lacks the user name: %s", data)
+	}
+}
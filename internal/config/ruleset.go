@@ -0,0 +1,380 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// RuleSetConfig references an external file of domains or networks that
+// routes can match with Match.RuleSets.
+type RuleSetConfig struct {
+	Path   string `yaml:"path,omitempty"`   // relative paths are resolved against the config file's directory
+	Format string `yaml:"format,omitempty"` // see RuleSetDomains (default)
+
+	// URL makes the rule set remote: it is downloaded every Interval
+	// (default DefaultRuleSetInterval) through Interface (default: the
+	// system default route) and cached at Path (default rule_sets/<name>).
+	URL       string        `yaml:"url,omitempty"`
+	Interval  time.Duration `yaml:"interval,omitempty"`
+	Interface string        `yaml:"interface,omitempty"`
+}
+
+// DefaultRuleSetInterval is how often remote rule sets are refreshed.
+const DefaultRuleSetInterval = 24 * time.Hour
+
+// RemoteRuleSet is a rule set to download, with its cache path resolved.
+type RemoteRuleSet struct {
+	Name      string
+	URL       string
+	Interval  time.Duration
+	Interface string
+	Format    string
+	Path      string
+}
+
+// Rule-set file formats. Text after '#' is a comment in all of them.
+const (
+	RuleSetDomains = "domains" // one pattern per line, as in Match.Domains
+	RuleSetCIDRs   = "cidrs"   // one IP address or CIDR per line
+	RuleSetHosts   = "hosts"   // hosts file: "0.0.0.0 ads.example.com tracker.example.com"; names match exactly
+	RuleSetDnsmasq = "dnsmasq" // "server=/example.com/1.1.1.1", "address=/example.com/..." etc.; domains match with their subdomains
+	RuleSetAdblock = "adblock" // "||example.com^" blocking rules; domains match with their subdomains
+)
+
+// maxRuleSetErrors bounds how many malformed lines are reported per file.
+const maxRuleSetErrors = 10
+
+// RuleSet is the parsed content of a rule-set file. Loaded rule sets are not
+// modified; a reload replaces them.
+type RuleSet struct {
+	Name    string
+	Path    string // resolved path
+	Format  string
+	URL     string   // set for remote rule sets, which are loaded from their cache at Path
+	Domains []string // patterns in Match.Domains syntax
+	IPs     []string // IP addresses and CIDRs
+
+	// Error is set if the file could not be read. The entries of the last
+	// successful load, if any, are kept.
+	Error string
+	// Errors describes up to maxRuleSetErrors malformed lines, out of
+	// InvalidLines in total. Valid lines are used regardless.
+	Errors       []string
+	InvalidLines int
+
+	LoadedAt time.Time // zero if the file was never read
+	modTime  time.Time
+	size     int64
+}
+
+// hostsNames are the hosts file entries for the local machine, which
+// blocklists in hosts format also carry.
+var hostsNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// validateRuleSet checks a rule-set definition.
+func (c *Config) validateRuleSet(name string, rs RuleSetConfig) error {
+	if rs.URL == "" {
+		if rs.Path == "" {
+			return fmt.Errorf("rule set %q: path or url is required", name)
+		}
+		if rs.Interval != 0 || rs.Interface != "" {
+			return fmt.Errorf("rule set %q: interval and interface require url", name)
+		}
+	} else {
+		u, err := url.Parse(rs.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rule set %q: url must be an http or https URL", name)
+		}
+		if rs.Interval < 0 {
+			return fmt.Errorf("rule set %q: interval must not be negative", name)
+		}
+		if rs.Interface != "" && !c.Interfaces.Has(rs.Interface) {
+			return fmt.Errorf("rule set %q: unknown interface %q", name, rs.Interface)
+		}
+	}
+	switch rs.Format {
+	case "", RuleSetDomains, RuleSetCIDRs, RuleSetHosts, RuleSetDnsmasq, RuleSetAdblock:
+		return nil
+	}
+	return fmt.Errorf("rule set %q: unknown format %q", name, rs.Format)
+}
+
+// ruleSetPath resolves a rule-set path against the config file's directory.
+func (cm *ConfigManager) ruleSetPath(name string, rs RuleSetConfig) string {
+	path := rs.Path
+	if path == "" {
+		path = filepath.Join("rule_sets", name)
+	}
+	return cm.ResolvePath(path)
+}
+
+// ruleSetFormat returns the rule set's format, or RuleSetDomains if unset.
+func ruleSetFormat(rs RuleSetConfig) string {
+	if rs.Format == "" {
+		return RuleSetDomains
+	}
+	return rs.Format
+}
+
+// RemoteRuleSets returns the rule sets that are downloaded from a URL.
+func (cm *ConfigManager) RemoteRuleSets() []RemoteRuleSet {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var remotes []RemoteRuleSet
+	for name, def := range cm.config.RuleSets {
+		if def.URL == "" {
+			continue
+		}
+		interval := def.Interval
+		if interval == 0 {
+			interval = DefaultRuleSetInterval
+		}
+		remotes = append(remotes, RemoteRuleSet{
+			Name:      name,
+			URL:       def.URL,
+			Interval:  interval,
+			Interface: def.Interface,
+			Format:    ruleSetFormat(def),
+			Path:      cm.ruleSetPath(name, def),
+		})
+	}
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].Name < remotes[j].Name })
+	return remotes
+}
+
+// loadRuleSets loads the rule sets defined in cfg, reusing those in prev
+// whose file, format and modification time are unchanged. It returns the
+// rule sets and the names of those that were (re)loaded.
+func (cm *ConfigManager) loadRuleSets(cfg *Config, prev map[string]*RuleSet) (map[string]*RuleSet, []string) {
+	sets := make(map[string]*RuleSet, len(cfg.RuleSets))
+	var loaded []string
+	for name, def := range cfg.RuleSets {
+		format := ruleSetFormat(def)
+		path := cm.ruleSetPath(name, def)
+		old := prev[name]
+		if old != nil && (old.Path != path || old.Format != format || old.URL != def.URL) {
+			old = nil
+		}
+
+		info, err := os.Stat(path)
+		if err == nil && old != nil && old.Error == "" && info.ModTime().Equal(old.modTime) && info.Size() == old.size {
+			sets[name] = old
+			continue
+		}
+
+		var rs *RuleSet
+		if err == nil {
+			rs, err = parseRuleSetFile(path, format)
+		}
+		if err == nil {
+			rs.modTime, rs.size = info.ModTime(), info.Size()
+		} else {
+			if def.URL != "" && os.IsNotExist(err) {
+				err = fmt.Errorf("not downloaded yet")
+			}
+			rs = &RuleSet{Error: err.Error()}
+			if old != nil {
+				rs.Domains, rs.IPs, rs.LoadedAt = old.Domains, old.IPs, old.LoadedAt
+			}
+		}
+		rs.Name, rs.Path, rs.Format, rs.URL = name, path, format, def.URL
+		sets[name] = rs
+		loaded = append(loaded, name)
+	}
+	sort.Strings(loaded)
+	return sets, loaded
+}
+
+// parseRuleSetFile parses a rule-set file.
+func parseRuleSetFile(path, format string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRuleSet(f, format)
+}
+
+// ParseRuleSet parses rule-set entries in the given format. Malformed lines
+// are recorded in the result's Errors and InvalidLines.
+func ParseRuleSet(r io.Reader, format string) (*RuleSet, error) {
+	rs := &RuleSet{Format: format, LoadedAt: time.Now()}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if err := rs.parseLine(strings.TrimSpace(scanner.Text())); err != nil {
+			rs.InvalidLines++
+			if len(rs.Errors) < maxRuleSetErrors {
+				rs.Errors = append(rs.Errors, fmt.Sprintf("line %d: %v", n, err))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rule set: %w", err)
+	}
+	return rs, nil
+}
+
+// parseLine adds the entries of one line in the rule set's format.
+func (rs *RuleSet) parseLine(line string) error {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if line == "" {
+		return nil
+	}
+
+	switch rs.Format {
+	case RuleSetCIDRs:
+		if _, _, err := net.ParseCIDR(line); err != nil && net.ParseIP(line) == nil {
+			return fmt.Errorf("invalid IP or CIDR %q", line)
+		}
+		rs.IPs = append(rs.IPs, line)
+
+	case RuleSetHosts:
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("expected an address followed by host names")
+		}
+		for _, name := range fields[1:] {
+			if !validDomain(name, "") {
+				return fmt.Errorf("invalid host name %q", name)
+			}
+			if !hostsNames[strings.ToLower(name)] {
+				rs.Domains = append(rs.Domains, name)
+			}
+		}
+
+	case RuleSetDnsmasq:
+		// option=/domain/[domain/...]value
+		option, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("expected option=/domain/")
+		}
+		switch option {
+		case "server", "local", "address", "ipset", "nftset":
+		default:
+			return fmt.Errorf("unsupported option %q", option)
+		}
+		parts := strings.Split(value, "/")
+		if len(parts) < 3 || parts[0] != "" {
+			return fmt.Errorf("expected %s=/domain/", option)
+		}
+		for _, domain := range parts[1 : len(parts)-1] {
+			if !validDomain(domain, "") {
+				return fmt.Errorf("invalid domain %q", domain)
+			}
+			rs.Domains = append(rs.Domains, "*."+domain)
+		}
+
+	case RuleSetAdblock:
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			// Comment or "[Adblock Plus 2.0]" header
+			return nil
+		}
+		domain, ok := strings.CutPrefix(line, "||")
+		if !ok {
+			return fmt.Errorf("only ||domain^ rules are supported")
+		}
+		domain, _, _ = strings.Cut(domain, "$")
+		domain, ok = strings.CutSuffix(domain, "^")
+		if !ok || !validDomain(domain, "") {
+			return fmt.Errorf("only ||domain^ rules are supported")
+		}
+		rs.Domains = append(rs.Domains, "*."+domain)
+
+	default:
+		if !validDomain(line, "*?[]^!\\") {
+			return fmt.Errorf("invalid domain %q", line)
+		}
+		rs.Domains = append(rs.Domains, line)
+	}
+	return nil
+}
+
+// validDomain reports whether name is made of letters, digits, '-', '_',
+// '.' and the given extra characters, e.g. glob syntax.
+func validDomain(name, extra string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_."+extra, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// RuleSets returns the loaded rule sets by name.
+func (cm *ConfigManager) RuleSets() map[string]*RuleSet {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	sets := make(map[string]*RuleSet, len(cm.ruleSets))
+	for name, rs := range cm.ruleSets {
+		sets[name] = rs
+	}
+	return sets
+}
+
+// ReloadRuleSets reloads the rule sets whose files changed, and returns the
+// names of those that were reloaded.
+func (cm *ConfigManager) ReloadRuleSets() []string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	sets, loaded := cm.loadRuleSets(cm.config, cm.ruleSets)
+	cm.ruleSets = sets
+	return loaded
+}
+
+// ruleSetDirs returns the directories holding local rule-set files. Remote
+// rule sets are reloaded by their downloader instead.
+func (cm *ConfigManager) ruleSetDirs() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var dirs []string
+	for _, rs := range cm.ruleSets {
+		if rs.URL == "" {
+			dirs = append(dirs, filepath.Dir(rs.Path))
+		}
+	}
+	return dirs
+}
+
+// isRuleSetFile reports whether path is one of the rule-set files.
+func (cm *ConfigManager) isRuleSetFile(path string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	for _, rs := range cm.ruleSets {
+		if filepath.Clean(rs.Path) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
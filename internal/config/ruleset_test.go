@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseRuleSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		lines   []string
+		domains []string
+		ips     []string
+		invalid []int // line numbers of malformed lines
+	}{
+		{
+			name:   "domains",
+			format: RuleSetDomains,
+			lines: []string{
+				"# comment",
+				"example.com",
+				"*.Example.org  # trailing comment",
+				"api-?.example.net",
+				"[ab].example.com",
+				"",
+				"bad/domain",
+				"two names.example",
+			},
+			domains: []string{"example.com", "*.Example.org", "api-?.example.net", "[ab].example.com"},
+			invalid: []int{7, 8},
+		},
+		{
+			name:   "cidrs",
+			format: RuleSetCIDRs,
+			lines: []string{
+				"10.0.0.0/8",
+				"192.0.2.1 # host",
+				"2001:db8::/32",
+				"10.0.0.0/33",
+				"example.com",
+			},
+			ips:     []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"},
+			invalid: []int{4, 5},
+		},
+		{
+			name:   "hosts",
+			format: RuleSetHosts,
+			lines: []string{
+				"# blocklist",
+				"127.0.0.1 localhost localhost.localdomain",
+				"::1 ip6-localhost ip6-loopback",
+				"255.255.255.255 broadcasthost",
+				"0.0.0.0 0.0.0.0",
+				"0.0.0.0 ads.example.com tracker.example.com",
+				"0.0.0.0 LocalHost Metrics.example.com",
+				"ads.example.net",
+				"banner.example.net 0.0.0.0",
+				"0.0.0.0 bad/name",
+			},
+			domains: []string{"ads.example.com", "tracker.example.com", "Metrics.example.com"},
+			invalid: []int{8, 9, 10},
+		},
+		{
+			name:   "dnsmasq",
+			format: RuleSetDnsmasq,
+			lines: []string{
+				"server=/a.example/b.example/1.1.1.1",
+				"address=/ads.example.com/0.0.0.0",
+				"local=/lan/",
+				"ipset=/stream.example/vpn",
+				"cache-size=1000",
+				"server=1.1.1.1",
+				"server",
+				"server=/bad domain/1.1.1.1",
+			},
+			domains: []string{"*.a.example", "*.b.example", "*.ads.example.com", "*.lan", "*.stream.example"},
+			invalid: []int{5, 6, 7, 8},
+		},
+		{
+			name:   "adblock",
+			format: RuleSetAdblock,
+			lines: []string{
+				"[Adblock Plus 2.0]",
+				"! Title: test list",
+				"||ads.example.com^",
+				"||tracker.example.com^$third-party",
+				"@@||good.example.com^",
+				"||noanchor.example.com",
+				"/banner/*",
+				"example.com##.ad",
+				"||*.example.com^",
+			},
+			domains: []string{"*.ads.example.com", "*.tracker.example.com"},
+			invalid: []int{5, 6, 7, 8, 9},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := ParseRuleSet(strings.NewReader(strings.Join(tt.lines, "\n")), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(rs.Domains, tt.domains) {
+				t.Errorf("Domains = %q, want %q", rs.Domains, tt.domains)
+			}
+			if !slices.Equal(rs.IPs, tt.ips) {
+				t.Errorf("IPs = %q, want %q", rs.IPs, tt.ips)
+			}
+			if rs.InvalidLines != len(tt.invalid) || len(rs.Errors) != len(tt.invalid) {
+				t.Fatalf("InvalidLines = %d, Errors = %q; want lines %v", rs.InvalidLines, rs.Errors, tt.invalid)
+			}
+			for i, n := range tt.invalid {
+				if prefix := fmt.Sprintf("line %d: ", n); !strings.HasPrefix(rs.Errors[i], prefix) {
+					t.Errorf("Errors[%d] = %q, want prefix %q", i, rs.Errors[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRuleSetErrorLimit(t *testing.T) {
+	var lines []string
+	for i := range maxRuleSetErrors + 5 {
+		lines = append(lines, fmt.Sprintf("bad domain %d", i), fmt.Sprintf("host%d.example.com", i))
+	}
+	rs, err := ParseRuleSet(strings.NewReader(strings.Join(lines, "\n")), RuleSetDomains)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.InvalidLines != maxRuleSetErrors+5 {
+		t.Errorf("InvalidLines = %d, want %d", rs.InvalidLines, maxRuleSetErrors+5)
+	}
+	if len(rs.Errors) != maxRuleSetErrors {
+		t.Errorf("len(Errors) = %d, want %d", len(rs.Errors), maxRuleSetErrors)
+	}
+	// Valid lines are used past the limit
+	if len(rs.Domains) != maxRuleSetErrors+5 {
+		t.Errorf("len(Domains) = %d, want %d", len(rs.Domains), maxRuleSetErrors+5)
+	}
+}
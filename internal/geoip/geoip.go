@@ -0,0 +1,134 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Databases holds the country and ASN databases used by GeoIP and ASN route
+// conditions, and reloads them when their files change.
+type Databases struct {
+	mu      sync.RWMutex
+	country *database
+	asn     *database
+}
+
+// database is a loaded MMDB file. It is read into memory rather than
+// mapped, so a replaced reader needs no closing while lookups may still use
+// it.
+type database struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// NewDatabases creates an empty set of databases; lookups find nothing
+// until Load succeeds.
+func NewDatabases() *Databases {
+	return &Databases{}
+}
+
+// Load opens the country and ASN databases at the given paths; an empty
+// path unloads that database. Files that are unchanged since the last Load
+// are kept. If a file fails to load, the database loaded before it, if any,
+// stays in use and the error is returned.
+func (d *Databases) Load(countryPath, asnPath string) error {
+	d.mu.RLock()
+	country, asn := d.country, d.asn
+	d.mu.RUnlock()
+
+	country, countryErr := load(country, countryPath)
+	asn, asnErr := load(asn, asnPath)
+
+	d.mu.Lock()
+	d.country, d.asn = country, asn
+	d.mu.Unlock()
+
+	if countryErr != nil {
+		return fmt.Errorf("country database: %w", countryErr)
+	}
+	if asnErr != nil {
+		return fmt.Errorf("ASN database: %w", asnErr)
+	}
+	return nil
+}
+
+// load opens the database at path unless prev holds the same, unchanged file.
+func load(prev *database, path string) (*database, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if prev != nil && prev.path != path {
+		prev = nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return prev, err
+	}
+	if prev != nil && info.ModTime().Equal(prev.modTime) && info.Size() == prev.size {
+		return prev, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return prev, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return prev, err
+	}
+	return &database{path: path, reader: reader, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Country returns the ISO 3166-1 country code of ip, or "" if unknown. The
+// registered country is used for addresses without a location, e.g. anycast.
+func (d *Databases) Country(ip netip.Addr) string {
+	d.mu.RLock()
+	db := d.country
+	d.mu.RUnlock()
+	if db == nil {
+		return ""
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := db.reader.Lookup(ip.AsSlice(), &record); err != nil {
+		return ""
+	}
+	code := record.Country.ISOCode
+	if code == "" {
+		code = record.RegisteredCountry.ISOCode
+	}
+	return strings.ToUpper(code)
+}
+
+// ASN returns the autonomous system number of ip, or 0 if unknown.
+func (d *Databases) ASN(ip netip.Addr) uint32 {
+	d.mu.RLock()
+	db := d.asn
+	d.mu.RUnlock()
+	if db == nil {
+		return 0
+	}
+
+	var record struct {
+		ASN uint32 `maxminddb:"autonomous_system_number"`
+	}
+	if err := db.reader.Lookup(ip.AsSlice(), &record); err != nil {
+		return 0
+	}
+	return record.ASN
+}
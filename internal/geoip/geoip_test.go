@@ -0,0 +1,68 @@
+package geoip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/test.mmdb is an IPv6 database with IPv4 networks in the mapped
+// subtree:
+//
+//	192.0.2.0/24   country tw, AS 15169
+//	8.8.8.0/24     registered country US, AS 15169
+//	2001:db8::/32  country CN, AS 4134
+//	10.0.0.0/8     continent only
+func TestDatabases(t *testing.T) {
+	d := NewDatabases()
+	if err := d.Load("testdata/test.mmdb", "testdata/test.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		country string
+		asn     uint32
+	}{
+		{"192.0.2.7", "TW", 15169},
+		{"8.8.8.8", "US", 15169},
+		{"2001:db8::1", "CN", 4134},
+		{"10.1.2.3", "", 0},
+		{"203.0.113.1", "", 0},
+	}
+	for _, tt := range tests {
+		ip := netip.MustParseAddr(tt.ip)
+		if got := d.Country(ip); got != tt.country {
+			t.Errorf("Country(%s) = %q, want %q", ip, got, tt.country)
+		}
+		if got := d.ASN(ip); got != tt.asn {
+			t.Errorf("ASN(%s) = %d, want %d", ip, got, tt.asn)
+		}
+	}
+}
+
+func TestDatabasesKeepPreviousOnError(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatabases()
+	if err := d.Load(path, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Load(path, ""); err == nil {
+		t.Fatal("Load of a truncated file succeeded")
+	}
+	if got := d.Country(netip.MustParseAddr("192.0.2.7")); got != "TW" {
+		t.Fatalf("Country after failed reload = %q, want TW", got)
+	}
+}
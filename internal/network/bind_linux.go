@@ -0,0 +1,70 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice returns a net.Dialer Control function that binds the socket
+// to the given device with SO_BINDTODEVICE, so traffic leaves through that
+// link regardless of the routing table.
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), device)
+		}); err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return deviceBindError(device, sockErr)
+		}
+		return nil
+	}
+}
+
+// CheckDeviceBinding verifies that sockets can be bound to the device.
+// It returns ErrDeviceBindPermission when the process lacks the privileges.
+func CheckDeviceBinding(device string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.BindToDevice(fd, device); err != nil {
+		return deviceBindError(device, err)
+	}
+	return nil
+}
+
+// deviceBindError wraps a SO_BINDTODEVICE failure with a hint about privileges.
+func deviceBindError(device string, err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("bind to device %s: %w (run as root or grant CAP_NET_RAW: setcap cap_net_raw+ep <binary>)", device, ErrDeviceBindPermission)
+	}
+	return fmt.Errorf("bind to device %s: %w", device, err)
+}
+
+// markSocket returns a net.Dialer Control function that sets SO_MARK on the
+// socket, so firewall rules can recognize the proxy's own traffic.
+func markSocket(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		}); err != nil {
+			return err
+		}
+		if errors.Is(sockErr, syscall.EPERM) {
+			return fmt.Errorf("set routing mark %d: %w (run as root or grant CAP_NET_ADMIN)", mark, sockErr)
+		}
+		if sockErr != nil {
+			return fmt.Errorf("set routing mark %d: %w", mark, sockErr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+var (
+	errDeviceBindUnsupported = errors.New("device binding is only supported on Linux")
+	errMarkUnsupported       = errors.New("routing marks are only supported on Linux")
+)
+
+// bindToDevice returns a net.Dialer Control function that always fails,
+// since SO_BINDTODEVICE is not available on this platform.
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("bind to device %s: %w", device, errDeviceBindUnsupported)
+	}
+}
+
+// CheckDeviceBinding reports that device binding is unsupported on this platform.
+func CheckDeviceBinding(device string) error {
+	return fmt.Errorf("bind to device %s: %w", device, errDeviceBindUnsupported)
+}
+
+// markSocket returns a net.Dialer Control function that always fails, since
+// SO_MARK is not available on this platform.
+func markSocket(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("set routing mark %d: %w", mark, errMarkUnsupported)
+	}
+}
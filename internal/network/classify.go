@@ -0,0 +1,171 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Link kinds assigned by DetectInterfaces.
+const (
+	KindWired    = "wired"
+	KindWireless = "wireless"
+	KindCellular = "cellular"
+	KindVirtual  = "virtual"
+	KindOther    = "other"
+)
+
+// Candidate is an interface classified and ranked for use as an uplink.
+type Candidate struct {
+	Name         string   `json:"name"`
+	Kind         string   `json:"kind"`
+	Carrier      bool     `json:"carrier"`
+	DefaultRoute bool     `json:"default_route"`
+	Addrs        []string `json:"addrs"`
+	Score        int      `json:"score"`
+	Reasons      []string `json:"reasons"` // why the interface got its kind and score
+}
+
+// linkClass is the platform-specific classification of a link.
+type linkClass struct {
+	kind   string
+	reason string
+}
+
+// DetectInterfaces classifies every non-loopback interface by its actual
+// link type, carrier state and default-route presence, and returns them
+// ranked best first.
+func DetectInterfaces() ([]Candidate, error) {
+	ifaces, err := scanInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	classes := classifyLinks(ifaces)
+	defaults := defaultRouteDevices()
+
+	candidates := make([]Candidate, 0, len(ifaces))
+	for _, iface := range ifaces {
+		class, ok := classes[iface.Name]
+		if !ok {
+			class = classifyByName(iface.Name)
+		}
+
+		c := Candidate{
+			Name:         iface.Name,
+			Kind:         class.kind,
+			Carrier:      linkUp(iface),
+			DefaultRoute: defaults[iface.Name],
+			Addrs:        interfaceAddrs(iface),
+		}
+		c.Reasons = append(c.Reasons, class.reason)
+
+		switch c.Kind {
+		case KindWired, KindWireless, KindCellular:
+			c.Score += 5
+		case KindVirtual:
+			c.Score -= 50
+		}
+
+		if c.Carrier {
+			c.Score += 20
+			c.Reasons = append(c.Reasons, "link up with carrier")
+		} else {
+			c.Reasons = append(c.Reasons, "no carrier")
+		}
+
+		if len(iface.IPv4Addrs) > 0 {
+			c.Score += 10
+			c.Reasons = append(c.Reasons, fmt.Sprintf("has IPv4 address %s", iface.IPv4Addrs[0]))
+		} else if addr := globalIPv6(iface.IPv6Addrs); addr != "" {
+			c.Score += 5
+			c.Reasons = append(c.Reasons, fmt.Sprintf("has global IPv6 address %s", addr))
+		} else {
+			c.Reasons = append(c.Reasons, "no usable address")
+		}
+
+		if c.DefaultRoute {
+			c.Score += 30
+			c.Reasons = append(c.Reasons, "has default route")
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	return candidates, nil
+}
+
+// BestCandidate returns the highest-ranked candidate of the given kind that
+// has an address.
+func BestCandidate(candidates []Candidate, kind string) (Candidate, bool) {
+	for _, c := range candidates {
+		if c.Kind == kind && len(c.Addrs) > 0 {
+			return c, true
+		}
+	}
+	return Candidate{}, false
+}
+
+// detectDevice returns the best device of the given kind.
+func detectDevice(kind string) (string, error) {
+	candidates, err := DetectInterfaces()
+	if err != nil {
+		return "", err
+	}
+	best, ok := BestCandidate(candidates, kind)
+	if !ok {
+		return "", fmt.Errorf("no %s interface detected", kind)
+	}
+	return best.Name, nil
+}
+
+// classifyByName guesses the kind of a link from its name alone.
+func classifyByName(name string) linkClass {
+	if isVirtualName(name) {
+		return linkClass{kind: KindVirtual, reason: "virtual interface name"}
+	}
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(lower, "wl"):
+		return linkClass{kind: KindWireless, reason: "wireless interface name"}
+	case strings.HasPrefix(lower, "ww"):
+		return linkClass{kind: KindCellular, reason: "cellular interface name"}
+	}
+	return linkClass{kind: KindOther, reason: "unknown link type"}
+}
+
+// virtualPrefixes are name prefixes of common virtual interfaces on Linux and macOS.
+var virtualPrefixes = []string{
+	"lo", "bridge", "br-", "virbr", "docker", "veth", "vnet", "tun", "tap", "utun",
+	"wg", "tailscale", "zt", "awdl", "llw", "anpi", "ap", "gif", "stf", "ifb", "dummy",
+	"vmnet", "vboxnet",
+}
+
+// isVirtualName reports whether the name looks like a virtual interface.
+func isVirtualName(name string) bool {
+	name = strings.ToLower(name)
+	for _, prefix := range virtualPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// globalIPv6 returns the first non-link-local IPv6 address, or "".
+func globalIPv6(addrs []string) string {
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && !ip.IsLinkLocalUnicast() {
+			return addr
+		}
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+//go:build darwin
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// classifyLinks classifies links by their macOS hardware port, as listed by
+// `networksetup -listallhardwareports`.
+func classifyLinks(ifaces []Interface) map[string]linkClass {
+	result := make(map[string]linkClass, len(ifaces))
+
+	output, err := exec.Command("networksetup", "-listallhardwareports").Output()
+	if err != nil {
+		return result
+	}
+
+	for port, device := range parseNetworkSetupOutput(string(output)) {
+		result[device] = classifyHardwarePort(port)
+	}
+	return result
+}
+
+// classifyHardwarePort maps a hardware port name to a link kind.
+func classifyHardwarePort(port string) linkClass {
+	reason := fmt.Sprintf("hardware port %q", port)
+	lower := strings.ToLower(port)
+	switch {
+	case strings.Contains(lower, "wi-fi") || strings.Contains(lower, "airport"):
+		return linkClass{kind: KindWireless, reason: reason}
+	case strings.Contains(lower, "iphone") || strings.Contains(lower, "ipad") || strings.Contains(lower, "modem"):
+		return linkClass{kind: KindCellular, reason: reason}
+	case strings.Contains(lower, "bridge") || strings.Contains(lower, "bluetooth"):
+		return linkClass{kind: KindVirtual, reason: reason}
+	}
+	return linkClass{kind: KindWired, reason: reason}
+}
+
+// defaultRouteDevices returns the devices that carry an IPv4 or IPv6
+// default route, as reported by `route -n get default`.
+func defaultRouteDevices() map[string]bool {
+	result := make(map[string]bool)
+	for _, args := range [][]string{
+		{"-n", "get", "default"},
+		{"-n", "get", "-inet6", "default"},
+	} {
+		output, err := exec.Command("route", args...).Output()
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(output)))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "interface:") {
+				result[strings.TrimSpace(strings.TrimPrefix(line, "interface:"))] = true
+			}
+		}
+	}
+	return result
+}
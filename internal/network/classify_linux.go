@@ -0,0 +1,128 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// arphrdEther is the ARPHRD_ETHER link type reported in /sys/class/net/*/type.
+const arphrdEther = 1
+
+// classifyLinks classifies links using sysfs: the DEVTYPE recorded in
+// uevent, the presence of wireless/phy80211 entries, and whether a physical
+// device backs the interface.
+func classifyLinks(ifaces []Interface) map[string]linkClass {
+	result := make(map[string]linkClass, len(ifaces))
+	for _, iface := range ifaces {
+		result[iface.Name] = classifyLink(iface.Name)
+	}
+	return result
+}
+
+// classifyLink classifies a single link from sysfs.
+func classifyLink(name string) linkClass {
+	base := filepath.Join(sysClassNet, name)
+
+	if exists(filepath.Join(base, "phy80211")) {
+		return linkClass{kind: KindWireless, reason: "nl80211 phy present (phy80211)"}
+	}
+	if exists(filepath.Join(base, "wireless")) {
+		return linkClass{kind: KindWireless, reason: "wireless extensions present in sysfs"}
+	}
+
+	switch devType := ueventDevType(name); devType {
+	case "wlan":
+		return linkClass{kind: KindWireless, reason: "uevent DEVTYPE=wlan"}
+	case "wwan":
+		return linkClass{kind: KindCellular, reason: "uevent DEVTYPE=wwan"}
+	case "":
+	default:
+		return linkClass{kind: KindVirtual, reason: fmt.Sprintf("uevent DEVTYPE=%s", devType)}
+	}
+
+	if !exists(filepath.Join(base, "device")) {
+		return linkClass{kind: KindVirtual, reason: "no backing device in sysfs"}
+	}
+
+	if driver, err := sysfsDriver(name); err == nil {
+		switch driver {
+		case "qmi_wwan", "cdc_mbim", "cdc_ncm_wwan", "option":
+			return linkClass{kind: KindCellular, reason: fmt.Sprintf("cellular driver %s", driver)}
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(base, "type"))
+	if err == nil {
+		if linkType, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && linkType == arphrdEther {
+			reason := "Ethernet device"
+			if driver, err := sysfsDriver(name); err == nil {
+				reason = fmt.Sprintf("Ethernet device (driver %s)", driver)
+			}
+			return linkClass{kind: KindWired, reason: reason}
+		}
+	}
+
+	return linkClass{kind: KindOther, reason: "non-Ethernet link type"}
+}
+
+// ueventDevType returns the DEVTYPE recorded in the device's uevent file.
+func ueventDevType(name string) string {
+	f, err := os.Open(filepath.Join(sysClassNet, name, "uevent"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "DEVTYPE=") {
+			return strings.TrimPrefix(line, "DEVTYPE=")
+		}
+	}
+	return ""
+}
+
+// defaultRouteDevices returns the devices that carry an IPv4 or IPv6
+// default route, read from /proc/net/route and /proc/net/ipv6_route.
+func defaultRouteDevices() map[string]bool {
+	result := make(map[string]bool)
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+				result[fields[0]] = true
+			}
+		}
+		f.Close()
+	}
+
+	// dest prefixlen src srclen nexthop metric refcnt use flags iface
+	if f, err := os.Open("/proc/net/ipv6_route"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 10 && strings.Trim(fields[0], "0") == "" && fields[1] == "00" && fields[9] != "lo" {
+				result[fields[9]] = true
+			}
+		}
+		f.Close()
+	}
+
+	return result
+}
+
+// exists reports whether the path exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package network
+
+// classifyLinks has no platform source here; links are classified by name.
+func classifyLinks(ifaces []Interface) map[string]linkClass {
+	return map[string]linkClass{}
+}
+
+// defaultRouteDevices is not implemented on this platform.
+func defaultRouteDevices() map[string]bool {
+	return map[string]bool{}
+}
@@ -2,17 +2,29 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/waylen888/splitdial/internal/logging"
 )
 
+// ErrInterfaceUnavailable is returned when an uplink cannot be used, e.g. its
+// device is missing or has no address for the target's IP family.
+var ErrInterfaceUnavailable = errors.New("interface unavailable")
+
+// ErrDeviceBindPermission is returned when binding a socket to a device
+// fails because the process lacks the required privileges.
+var ErrDeviceBindPermission = errors.New("binding to a device requires root or CAP_NET_RAW")
+
 // InterfaceDialer creates network connections bound to a specific interface.
 type InterfaceDialer struct {
 	interfaceManager *InterfaceManager
 	timeout          time.Duration
+	mark             atomic.Int64 // SO_MARK for outbound sockets, 0 for none
 }
 
 // NewInterfaceDialer creates a new interface-bound dialer.
@@ -26,63 +38,261 @@ func NewInterfaceDialer(im *InterfaceManager, timeout time.Duration) *InterfaceD
 	}
 }
 
-// DialContext creates a connection to the address using the specified interface.
-func (id *InterfaceDialer) DialContext(ctx context.Context, network, address, interfaceType string) (net.Conn, error) {
-	// Use GetLocalAddrForTarget to select appropriate IPv4 or IPv6 local address
-	localAddr, err := id.interfaceManager.GetLocalAddrForTarget(interfaceType, address)
+// SetMark sets the SO_MARK applied to every outbound socket, including those
+// using the default route, so firewall rules for transparent proxying can
+// skip the proxy's own traffic. Zero disables marking. It can be called
+// again on config reload; sockets opened from then on carry the new mark.
+func (id *InterfaceDialer) SetMark(mark int) {
+	id.mark.Store(int64(mark))
+}
+
+// socketControl returns the Control function for an outbound socket: bound
+// to device unless it is empty, and marked if a routing mark is set.
+func (id *InterfaceDialer) socketControl(device string) func(network, address string, c syscall.RawConn) error {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if device != "" {
+		controls = append(controls, bindToDevice(device))
+	}
+	if mark := int(id.mark.Load()); mark != 0 {
+		controls = append(controls, markSocket(mark))
+	}
+	if len(controls) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// DialContext creates a connection to the address using the specified uplink.
+// If the uplink is unavailable it returns an error wrapping
+// ErrInterfaceUnavailable rather than using another route.
+func (id *InterfaceDialer) DialContext(ctx context.Context, network, address, uplink string) (net.Conn, error) {
+	dialer, err := id.dialerFor(uplink, address)
 	if err != nil {
-		logging.Warn("Interface unavailable, falling back to default route",
-			"interface", interfaceType,
-			"target", address,
-			"error", err,
-		)
-		// Fallback: Proceed with nil localAddr (system default)
-		localAddr = nil
+		return nil, fmt.Errorf("failed to dial %s via %s: %w", address, uplink, err)
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s via %s: %w", address, uplink, err)
+	}
+
+	return conn, nil
+}
+
+// DialDefaultContext creates a connection using the system default route.
+func (id *InterfaceDialer) DialDefaultContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: id.timeout, Control: id.socketControl("")}
+
+	logging.Debug("Dialing connection via default route", "address", address)
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s via default route: %w", address, err)
+	}
+
+	return conn, nil
+}
+
+// dialerFor builds a net.Dialer bound to the uplink according to its bind mode.
+func (id *InterfaceDialer) dialerFor(uplink, address string) (*net.Dialer, error) {
+	u, err := id.interfaceManager.Uplink(uplink)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInterfaceUnavailable, err)
+	}
+
+	dialer := &net.Dialer{Timeout: id.timeout, Control: id.socketControl("")}
+
+	if u.bindsIP() {
+		// Use GetLocalAddrForTarget to select appropriate IPv4 or IPv6 local address
+		localAddr, err := id.interfaceManager.GetLocalAddrForTarget(uplink, address)
+		if err != nil {
+			if !u.bindsDevice() {
+				return nil, fmt.Errorf("%w: %v", ErrInterfaceUnavailable, err)
+			}
+			// Device binding alone still pins the socket to the interface
+		} else {
+			dialer.LocalAddr = localAddr
+		}
+	}
+
+	if u.bindsDevice() {
+		if _, err := net.InterfaceByName(u.Device); err != nil {
+			return nil, fmt.Errorf("%w: device %s: %v", ErrInterfaceUnavailable, u.Device, err)
+		}
+		dialer.Control = id.socketControl(u.Device)
+	}
+
+	// Resolve hostnames through the uplink's own nameservers
+	if len(u.DNS) > 0 {
+		dialer.Resolver = id.resolverFor(uplink, u)
 	}
 
 	logging.Debug("Dialing connection",
 		"address", address,
-		"interface", interfaceType,
-		"local_addr", localAddr.String(),
+		"interface", uplink,
+		"device", u.Device,
+		"bind", u.Bind,
+		"local_addr", fmt.Sprint(dialer.LocalAddr),
 	)
 
-	dialer := &net.Dialer{
-		LocalAddr: localAddr,
-		Timeout:   id.timeout,
+	return dialer, nil
+}
+
+// ListenPacket opens a UDP socket bound to the uplink for sending to target.
+// Target only selects the IP family of the local address, so the socket can
+// be reused for other destinations of the same family. If the uplink is
+// unavailable the error wraps ErrInterfaceUnavailable.
+func (id *InterfaceDialer) ListenPacket(ctx context.Context, uplink, target string) (net.PacketConn, error) {
+	dialer, err := id.dialerFor(uplink, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen via %s: %w", uplink, err)
 	}
 
-	conn, err := dialer.DialContext(ctx, network, address)
+	address := ":0"
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		address = net.JoinHostPort(local.IP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: dialer.Control}
+	conn, err := lc.ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen via %s: %w", uplink, err)
+	}
+
+	return conn, nil
+}
+
+// ListenPacketDefault opens a UDP socket that sends through the system
+// default route.
+func (id *InterfaceDialer) ListenPacketDefault(ctx context.Context) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: id.socketControl("")}
+	conn, err := lc.ListenPacket(ctx, "udp", ":0")
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial %s via %s: %w", address, interfaceType, err)
+		return nil, fmt.Errorf("failed to listen via default route: %w", err)
 	}
 
 	return conn, nil
 }
 
-// Dial creates a connection to the address using the specified interface.
-func (id *InterfaceDialer) Dial(network, address, interfaceType string) (net.Conn, error) {
-	return id.DialContext(context.Background(), network, address, interfaceType)
+// Listen opens a TCP listener on the uplink for accepting a connection from
+// target, which selects the IP family of the local address. If the uplink is
+// unavailable the error wraps ErrInterfaceUnavailable.
+func (id *InterfaceDialer) Listen(ctx context.Context, uplink, target string) (net.Listener, error) {
+	dialer, err := id.dialerFor(uplink, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen via %s: %w", uplink, err)
+	}
+
+	address := ":0"
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		address = net.JoinHostPort(local.IP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: dialer.Control}
+	ln, err := lc.Listen(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen via %s: %w", uplink, err)
+	}
+
+	return ln, nil
+}
+
+// ListenDefault opens a TCP listener for accepting a connection from target
+// through the system default route, on the local address the system would
+// use to reach target. A target with an unspecified address (BIND requests
+// often send 0.0.0.0:0) uses the default route's address for its family,
+// or all addresses if there is no default route.
+func (id *InterfaceDialer) ListenDefault(ctx context.Context, target string) (net.Listener, error) {
+	address := ":0"
+	if probeTarget, wildcard := defaultRouteProbe(target); probeTarget != "" {
+		address = net.JoinHostPort(wildcard, "0")
+		// Connecting a UDP socket selects a source address without sending anything
+		var d net.Dialer
+		probe, err := d.DialContext(ctx, "udp", probeTarget)
+		if err == nil {
+			address = net.JoinHostPort(probe.LocalAddr().(*net.UDPAddr).IP.String(), "0")
+			probe.Close()
+		} else if probeTarget == target {
+			return nil, fmt.Errorf("failed to listen via default route: %w", err)
+		}
+	}
+
+	lc := net.ListenConfig{Control: id.socketControl("")}
+	ln, err := lc.Listen(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen via default route: %w", err)
+	}
+
+	return ln, nil
+}
+
+// defaultRouteProbe returns the address to connect a UDP probe to for
+// finding the local address that reaches target, and the wildcard address of
+// target's family. An unspecified or missing host probes a public address of
+// its family instead, and a zero port (which cannot be connected to) is
+// replaced. It returns "" if target is not host:port.
+func defaultRouteProbe(target string) (probe, wildcard string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", ""
+	}
+	ip := net.ParseIP(host)
+	wildcard = "0.0.0.0"
+	if ip != nil && ip.To4() == nil {
+		wildcard = "::"
+	}
+
+	switch {
+	case host == "" || (ip != nil && ip.IsUnspecified()):
+		// Nothing is sent, so any global address of the family will do
+		if wildcard == "::" {
+			return "[2001:4860:4860::8888]:53", wildcard
+		}
+		return "8.8.8.8:53", wildcard
+	case port == "0":
+		return net.JoinHostPort(host, "9"), wildcard
+	}
+	return target, wildcard
+}
+
+// Dial creates a connection to the address using the specified uplink.
+func (id *InterfaceDialer) Dial(network, address, uplink string) (net.Conn, error) {
+	return id.DialContext(context.Background(), network, address, uplink)
 }
 
-// DialTCP creates a TCP connection bound to the specified interface.
-func (id *InterfaceDialer) DialTCP(address, interfaceType string) (net.Conn, error) {
-	return id.Dial("tcp", address, interfaceType)
+// DialTCP creates a TCP connection bound to the specified uplink.
+func (id *InterfaceDialer) DialTCP(address, uplink string) (net.Conn, error) {
+	return id.Dial("tcp", address, uplink)
 }
 
-// DialUDP creates a UDP connection bound to the specified interface.
-func (id *InterfaceDialer) DialUDP(address, interfaceType string) (net.Conn, error) {
-	return id.Dial("udp", address, interfaceType)
+// DialUDP creates a UDP connection bound to the specified uplink.
+func (id *InterfaceDialer) DialUDP(address, uplink string) (net.Conn, error) {
+	return id.Dial("udp", address, uplink)
 }
 
-// DialerForInterface returns a standard net.Dialer configured for the interface.
-func (id *InterfaceDialer) DialerForInterface(interfaceType string) (*net.Dialer, error) {
-	localAddr, err := id.interfaceManager.GetLocalAddr(interfaceType)
+// DialerForInterface returns a standard net.Dialer configured for the uplink.
+func (id *InterfaceDialer) DialerForInterface(uplink string) (*net.Dialer, error) {
+	u, err := id.interfaceManager.Uplink(uplink)
 	if err != nil {
 		return nil, err
 	}
 
-	return &net.Dialer{
-		LocalAddr: localAddr,
-		Timeout:   id.timeout,
-	}, nil
+	dialer := &net.Dialer{Timeout: id.timeout, Control: id.socketControl("")}
+	if u.bindsIP() {
+		localAddr, err := id.interfaceManager.GetLocalAddr(uplink)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = localAddr
+	}
+	if u.bindsDevice() {
+		dialer.Control = id.socketControl(u.Device)
+	}
+
+	return dialer, nil
 }
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDefaultRouteProbe(t *testing.T) {
+	tests := []struct {
+		target, probe, wildcard string
+	}{
+		{"203.0.113.7:21", "203.0.113.7:21", "0.0.0.0"},
+		{"203.0.113.7:0", "203.0.113.7:9", "0.0.0.0"},
+		{"0.0.0.0:0", "8.8.8.8:53", "0.0.0.0"},
+		{"[::]:0", "[2001:4860:4860::8888]:53", "::"},
+		{"[2001:db8::1]:0", "[2001:db8::1]:9", "::"},
+		{":0", "8.8.8.8:53", "0.0.0.0"},
+		{"example.com:0", "example.com:9", "0.0.0.0"},
+		{"bogus", "", ""},
+	}
+	for _, tt := range tests {
+		probe, wildcard := defaultRouteProbe(tt.target)
+		if probe != tt.probe || wildcard != tt.wildcard {
+			t.Errorf("defaultRouteProbe(%q) = %q, %q; want %q, %q", tt.target, probe, wildcard, tt.probe, tt.wildcard)
+		}
+	}
+}
+
+func TestListenDefaultUnspecifiedTarget(t *testing.T) {
+	id := NewInterfaceDialer(nil, 0)
+	ln, err := id.ListenDefault(t.Context(), "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Connecting to 0.0.0.0 would pick the loopback address
+	if ip := ln.Addr().(*net.TCPAddr).IP; ip.IsLoopback() {
+		t.Fatalf("listening on %s, want the default route's address", ip)
+	}
+}
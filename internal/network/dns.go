@@ -0,0 +1,53 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+// resolverFor returns a resolver that sends its queries to the uplink's
+// nameservers through the uplink itself, so answers match the network the
+// connection will use and lookups do not leak onto other links. Each query
+// goes to the next nameserver in turn, so retries move on to the next one.
+func (id *InterfaceDialer) resolverFor(uplink string, u Uplink) *net.Resolver {
+	servers := u.DNS
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			dialer, err := id.dialerFor(uplink, server)
+			if err != nil {
+				return nil, fmt.Errorf("nameserver %s via %s: %w", server, uplink, err)
+			}
+			if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok && strings.HasPrefix(network, "udp") {
+				dialer.LocalAddr = &net.UDPAddr{IP: local.IP, Zone: local.Zone}
+			}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// LookupIPAddr resolves host through the uplink's nameservers, or the system
+// resolver if the uplink has none.
+func (id *InterfaceDialer) LookupIPAddr(ctx context.Context, uplink, host string) ([]net.IPAddr, error) {
+	u, err := id.interfaceManager.Uplink(uplink)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInterfaceUnavailable, err)
+	}
+	if len(u.DNS) == 0 {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+
+	addrs, err := id.resolverFor(uplink, u).LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s via %s: %w", host, uplink, err)
+	}
+	logging.Debug("Resolved via interface DNS", "host", host, "interface", uplink, "addrs", fmt.Sprint(addrs))
+	return addrs, nil
+}
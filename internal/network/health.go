@@ -0,0 +1,293 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+// HealthStatus is the probing state of an uplink.
+type HealthStatus struct {
+	Interface            string    `json:"interface"`
+	Healthy              bool      `json:"healthy"`
+	LastCheck            time.Time `json:"last_check"`
+	LastChange           time.Time `json:"last_change"`
+	LastError            string    `json:"last_error,omitempty"`
+	LatencyMs            float64   `json:"latency_ms"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+}
+
+// HealthChecker periodically probes each uplink through its own interface and
+// tracks whether it has connectivity.
+type HealthChecker struct {
+	dialer *InterfaceDialer
+
+	mu      sync.RWMutex
+	cfg     config.HealthCheckConfig
+	targets map[string][]string // uplink name -> probe targets
+	status  map[string]*HealthStatus
+	wake    chan struct{}
+}
+
+// NewHealthChecker creates a new health checker that probes through the dialer.
+func NewHealthChecker(dialer *InterfaceDialer) *HealthChecker {
+	return &HealthChecker{
+		dialer:  dialer,
+		targets: make(map[string][]string),
+		status:  make(map[string]*HealthStatus),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Configure applies health check settings and the set of uplinks to probe.
+// It can be called again on config reload.
+func (hc *HealthChecker) Configure(cfg config.HealthCheckConfig, specs config.InterfaceConfig) {
+	defaults := config.DefaultConfig().HealthCheck
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaults.Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	if len(cfg.Targets) == 0 {
+		cfg.Targets = defaults.Targets
+	}
+	if cfg.FailThreshold <= 0 {
+		cfg.FailThreshold = defaults.FailThreshold
+	}
+	if cfg.RiseThreshold <= 0 {
+		cfg.RiseThreshold = defaults.RiseThreshold
+	}
+
+	targets := make(map[string][]string, len(specs))
+	for name, spec := range specs {
+		if len(spec.HealthTargets) > 0 {
+			targets[name] = spec.HealthTargets
+		} else {
+			targets[name] = cfg.Targets
+		}
+	}
+
+	hc.mu.Lock()
+	hc.cfg = cfg
+	hc.targets = targets
+	for name := range hc.status {
+		if _, ok := targets[name]; !ok {
+			delete(hc.status, name)
+		}
+	}
+	hc.mu.Unlock()
+
+	// Probe immediately with the new settings
+	hc.Recheck()
+}
+
+// Recheck requests an immediate probe round, e.g. after a link change.
+func (hc *HealthChecker) Recheck() {
+	select {
+	case hc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the probe loop until the context is cancelled.
+func (hc *HealthChecker) Start(ctx context.Context) {
+	for {
+		hc.mu.RLock()
+		enabled := hc.cfg.Enabled
+		interval := hc.cfg.Interval
+		hc.mu.RUnlock()
+
+		if enabled {
+			hc.probeAll(ctx)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-hc.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// IsHealthy reports whether the uplink is usable. Uplinks are considered
+// healthy when health checking is disabled or they have not been probed yet.
+func (hc *HealthChecker) IsHealthy(uplink string) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	if !hc.cfg.Enabled {
+		return true
+	}
+	st, ok := hc.status[uplink]
+	if !ok {
+		return true
+	}
+	return st.Healthy
+}
+
+// Status returns the current health of every probed uplink, sorted by name.
+func (hc *HealthChecker) Status() []HealthStatus {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	result := make([]HealthStatus, 0, len(hc.status))
+	for _, st := range hc.status {
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Interface < result[j].Interface
+	})
+	return result
+}
+
+// Enabled reports whether health checking is turned on.
+func (hc *HealthChecker) Enabled() bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.cfg.Enabled
+}
+
+// probeAll probes every uplink concurrently and records the results.
+func (hc *HealthChecker) probeAll(ctx context.Context) {
+	hc.mu.RLock()
+	cfg := hc.cfg
+	targets := make(map[string][]string, len(hc.targets))
+	for name, t := range hc.targets {
+		targets[name] = t
+	}
+	hc.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for name, t := range targets {
+		wg.Add(1)
+		go func(name string, t []string) {
+			defer wg.Done()
+			start := time.Now()
+			err := hc.probe(ctx, name, t, cfg.Timeout)
+			hc.record(name, err, time.Since(start), cfg)
+		}(name, t)
+	}
+	wg.Wait()
+}
+
+// probe checks an uplink against its targets. It succeeds if any target does.
+func (hc *HealthChecker) probe(ctx context.Context, uplink string, targets []string, timeout time.Duration) error {
+	var lastErr error
+	for _, target := range targets {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := hc.probeTarget(probeCtx, uplink, target)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no probe targets configured")
+	}
+	return lastErr
+}
+
+// probeTarget probes a single target, either "tcp://host:port" or an HTTP(S) URL.
+func (hc *HealthChecker) probeTarget(ctx context.Context, uplink, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid probe target %q: %w", target, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		conn, err := hc.dialer.DialContext(ctx, "tcp", u.Host, uplink)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case "http", "https":
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return hc.dialer.DialContext(ctx, network, addr, uplink)
+				},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("probe %s returned %s", target, resp.Status)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported probe scheme %q in %q", u.Scheme, target)
+	}
+}
+
+// record updates an uplink's status with a probe result.
+func (hc *HealthChecker) record(uplink string, probeErr error, latency time.Duration, cfg config.HealthCheckConfig) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	// The uplink may have been removed by a reload while probing
+	if _, ok := hc.targets[uplink]; !ok {
+		return
+	}
+
+	now := time.Now()
+	st, ok := hc.status[uplink]
+	if !ok {
+		st = &HealthStatus{Interface: uplink, Healthy: true, LastChange: now}
+		hc.status[uplink] = st
+	}
+	st.LastCheck = now
+
+	if probeErr != nil {
+		st.ConsecutiveFailures++
+		st.ConsecutiveSuccesses = 0
+		st.LastError = probeErr.Error()
+		st.LatencyMs = 0
+		if st.Healthy && st.ConsecutiveFailures >= cfg.FailThreshold {
+			st.Healthy = false
+			st.LastChange = now
+			logging.Warn("Interface marked unhealthy", "interface", uplink, "failures", st.ConsecutiveFailures, "error", probeErr)
+		} else {
+			logging.Debug("Health probe failed", "interface", uplink, "error", probeErr)
+		}
+		return
+	}
+
+	st.ConsecutiveSuccesses++
+	st.ConsecutiveFailures = 0
+	st.LastError = ""
+	st.LatencyMs = float64(latency.Microseconds()) / 1000
+	if !st.Healthy && st.ConsecutiveSuccesses >= cfg.RiseThreshold {
+		st.Healthy = true
+		st.LastChange = now
+		logging.Info("Interface healthy again", "interface", uplink, "latency", latency)
+	}
+}
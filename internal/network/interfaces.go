@@ -3,36 +3,144 @@ package network
 import (
 	"fmt"
 	"net"
-	"strings"
+	"sort"
+	"sync"
+
+	"github.com/waylen888/splitdial/internal/config"
 )
 
 // Interface represents a network interface with its addresses.
 type Interface struct {
 	Name       string   `json:"name"`
-	Type       string   `json:"type"` // "cable", "wifi", "other"
+	Type       string   `json:"type"` // configured uplink name, "virtual" or "other"
 	IPv4Addrs  []string `json:"ipv4_addrs"`
 	IPv6Addrs  []string `json:"ipv6_addrs"`
 	MACAddress string   `json:"mac_address"`
 	IsUp       bool     `json:"is_up"`
+	IsRunning  bool     `json:"is_running"` // link has carrier
 	MTU        int      `json:"mtu"`
 }
 
+// Uplink is a configured interface resolved to its device.
+type Uplink struct {
+	Device string   // device name (e.g., "en0")
+	Bind   string   // config.BindIP, config.BindDevice or config.BindBoth
+	DNS    []string // nameservers (host:port) queried through the uplink; empty uses the system resolver
+}
+
+// bindsIP reports whether sockets should be bound to the interface address.
+func (u Uplink) bindsIP() bool {
+	return u.Bind != config.BindDevice
+}
+
+// bindsDevice reports whether sockets should be bound to the device.
+func (u Uplink) bindsDevice() bool {
+	return u.Bind == config.BindDevice || u.Bind == config.BindBoth
+}
+
 // InterfaceManager handles network interface detection and management.
 type InterfaceManager struct {
-	cableInterfaceName string
-	wifiInterfaceName  string
+	mu      sync.RWMutex
+	uplinks map[string]Uplink // uplink name -> resolved uplink
+	watcher *InterfaceWatcher // optional cached interface source
 }
 
 // NewInterfaceManager creates a new interface manager.
-func NewInterfaceManager(cableName, wifiName string) *InterfaceManager {
-	return &InterfaceManager{
-		cableInterfaceName: cableName,
-		wifiInterfaceName:  wifiName,
+// uplinks maps each configured uplink name to its resolved device.
+func NewInterfaceManager(uplinks map[string]Uplink) *InterfaceManager {
+	im := &InterfaceManager{}
+	im.SetUplinks(uplinks)
+	return im
+}
+
+// SetUplinks replaces the uplink mappings.
+func (im *InterfaceManager) SetUplinks(uplinks map[string]Uplink) {
+	copied := make(map[string]Uplink, len(uplinks))
+	for name, uplink := range uplinks {
+		copied[name] = uplink
 	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.uplinks = copied
+}
+
+// Devices returns a copy of the uplink name to device name mappings.
+func (im *InterfaceManager) Devices() map[string]string {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
+	result := make(map[string]string, len(im.uplinks))
+	for name, uplink := range im.uplinks {
+		result[name] = uplink.Device
+	}
+	return result
+}
+
+// Uplink returns the resolved uplink with the given name.
+func (im *InterfaceManager) Uplink(name string) (Uplink, error) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
+	uplink, ok := im.uplinks[name]
+	if !ok {
+		return Uplink{}, fmt.Errorf("unknown interface: %s", name)
+	}
+	if uplink.Device == "" {
+		return Uplink{}, fmt.Errorf("interface %s has no resolved device", name)
+	}
+	return uplink, nil
+}
+
+// DeviceName returns the device name for the given uplink.
+func (im *InterfaceManager) DeviceName(uplink string) (string, error) {
+	u, err := im.Uplink(uplink)
+	if err != nil {
+		return "", err
+	}
+	return u.Device, nil
+}
+
+// SetWatcher makes the manager read interfaces from the watcher's cached
+// snapshot instead of querying the system on every call.
+func (im *InterfaceManager) SetWatcher(w *InterfaceWatcher) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.watcher = w
 }
 
 // ListInterfaces returns all available network interfaces.
 func (im *InterfaceManager) ListInterfaces() ([]Interface, error) {
+	im.mu.RLock()
+	w := im.watcher
+	im.mu.RUnlock()
+
+	var ifaces []Interface
+	if w != nil {
+		ifaces = w.Snapshot()
+	} else {
+		var err error
+		if ifaces, err = scanInterfaces(); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []Interface
+	for _, iface := range ifaces {
+		// Only include interfaces with at least one IP address
+		if len(iface.IPv4Addrs) == 0 && len(iface.IPv6Addrs) == 0 {
+			continue
+		}
+		iface.Type = im.detectInterfaceType(iface.Name)
+		result = append(result, iface)
+	}
+
+	return result, nil
+}
+
+// scanInterfaces queries the system for all non-loopback interfaces and their
+// addresses. The Type field is left empty.
+func scanInterfaces() ([]Interface, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list interfaces: %w", err)
@@ -40,7 +148,7 @@ func (im *InterfaceManager) ListInterfaces() ([]Interface, error) {
 
 	var result []Interface
 	for _, iface := range ifaces {
-		// Skip loopback and inactive interfaces
+		// Skip loopback interfaces
 		if iface.Flags&net.FlagLoopback != 0 {
 			continue
 		}
@@ -52,9 +160,9 @@ func (im *InterfaceManager) ListInterfaces() ([]Interface, error) {
 
 		netIface := Interface{
 			Name:       iface.Name,
-			Type:       im.detectInterfaceType(iface.Name),
 			MACAddress: iface.HardwareAddr.String(),
 			IsUp:       iface.Flags&net.FlagUp != 0,
+			IsRunning:  iface.Flags&net.FlagRunning != 0,
 			MTU:        iface.MTU,
 		}
 
@@ -72,30 +180,22 @@ func (im *InterfaceManager) ListInterfaces() ([]Interface, error) {
 			}
 		}
 
-		// Only include interfaces with at least one IP address
-		if len(netIface.IPv4Addrs) > 0 || len(netIface.IPv6Addrs) > 0 {
-			result = append(result, netIface)
-		}
+		result = append(result, netIface)
 	}
 
 	return result, nil
 }
 
-// GetInterfaceByType returns the interface by type ("cable" or "wifi").
-func (im *InterfaceManager) GetInterfaceByType(interfaceType string) (*Interface, error) {
-	ifaces, err := im.ListInterfaces()
+// GetInterfaceByName returns the interface for a configured uplink name.
+func (im *InterfaceManager) GetInterfaceByName(uplink string) (*Interface, error) {
+	targetName, err := im.DeviceName(uplink)
 	if err != nil {
 		return nil, err
 	}
 
-	var targetName string
-	switch interfaceType {
-	case "cable":
-		targetName = im.cableInterfaceName
-	case "wifi":
-		targetName = im.wifiInterfaceName
-	default:
-		return nil, fmt.Errorf("unknown interface type: %s", interfaceType)
+	ifaces, err := im.ListInterfaces()
+	if err != nil {
+		return nil, err
 	}
 
 	for _, iface := range ifaces {
@@ -107,9 +207,9 @@ func (im *InterfaceManager) GetInterfaceByType(interfaceType string) (*Interface
 	return nil, fmt.Errorf("interface %s not found", targetName)
 }
 
-// GetLocalAddr returns the local IPv4 address to bind for a given interface type.
-func (im *InterfaceManager) GetLocalAddr(interfaceType string) (*net.TCPAddr, error) {
-	iface, err := im.GetInterfaceByType(interfaceType)
+// GetLocalAddr returns the local IPv4 address to bind for a given uplink.
+func (im *InterfaceManager) GetLocalAddr(uplink string) (*net.TCPAddr, error) {
+	iface, err := im.GetInterfaceByName(uplink)
 	if err != nil {
 		return nil, err
 	}
@@ -128,8 +228,8 @@ func (im *InterfaceManager) GetLocalAddr(interfaceType string) (*net.TCPAddr, er
 
 // GetLocalAddrForTarget returns the appropriate local address based on the target address.
 // If the target is IPv6, it returns an IPv6 local address. Otherwise, it returns IPv4.
-func (im *InterfaceManager) GetLocalAddrForTarget(interfaceType string, targetAddr string) (*net.TCPAddr, error) {
-	iface, err := im.GetInterfaceByType(interfaceType)
+func (im *InterfaceManager) GetLocalAddrForTarget(uplink string, targetAddr string) (*net.TCPAddr, error) {
+	iface, err := im.GetInterfaceByName(uplink)
 	if err != nil {
 		return nil, err
 	}
@@ -195,76 +295,35 @@ func (im *InterfaceManager) GetLocalAddrForTarget(interfaceType string, targetAd
 	return &net.TCPAddr{IP: ip, Port: 0}, nil
 }
 
-// detectInterfaceType attempts to detect the interface type based on name.
+// detectInterfaceType returns the uplink name configured for the device,
+// or attempts to detect the interface type based on name.
 func (im *InterfaceManager) detectInterfaceType(name string) string {
-	if name == im.cableInterfaceName {
-		return "cable"
-	}
-	if name == im.wifiInterfaceName {
-		return "wifi"
+	if uplink := im.UplinkForDevice(name); uplink != "" {
+		return uplink
 	}
 
-	// Common patterns on macOS
-	name = strings.ToLower(name)
-	if strings.HasPrefix(name, "en") {
-		// On macOS, en0 is usually built-in ethernet, en1 is usually Wi-Fi
-		// but this can vary by hardware configuration
-		return "other"
-	}
-	if strings.HasPrefix(name, "bridge") || strings.HasPrefix(name, "awdl") ||
-		strings.HasPrefix(name, "llw") || strings.HasPrefix(name, "utun") {
-		return "virtual"
+	if isVirtualName(name) {
+		return KindVirtual
 	}
 
-	return "other"
+	return KindOther
 }
 
-// DetectInterfaces automatically detects cable and wifi interfaces.
-func DetectInterfaces() (cable, wifi string, err error) {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return "", "", err
-	}
-
-	// On macOS, we try to find interfaces by examining their properties
-	// This is a heuristic approach and may not work for all systems
-	for _, iface := range ifaces {
-		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
+// UplinkForDevice returns the first uplink name (in sorted order) mapped to
+// the device, or "" if the device is not configured.
+func (im *InterfaceManager) UplinkForDevice(device string) string {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
 
-		hasIPv4 := false
-		for _, addr := range addrs {
-			if ipNet, ok := addr.(*net.IPNet); ok {
-				if ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
-					hasIPv4 = true
-					break
-				}
-			}
-		}
-
-		if !hasIPv4 {
-			continue
-		}
-
-		// Heuristic: on macOS, en0 is often ethernet, en1 is often wifi
-		// We detect based on interface names
-		switch iface.Name {
-		case "en0":
-			if cable == "" {
-				cable = iface.Name
-			}
-		case "en1":
-			if wifi == "" {
-				wifi = iface.Name
-			}
+	var uplinks []string
+	for name, uplink := range im.uplinks {
+		if uplink.Device == device {
+			uplinks = append(uplinks, name)
 		}
 	}
-
-	return cable, wifi, nil
+	if len(uplinks) == 0 {
+		return ""
+	}
+	sort.Strings(uplinks)
+	return uplinks[0]
 }
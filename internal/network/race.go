@@ -0,0 +1,231 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+// raceAttempt is one connection attempt of a race: an address dialed
+// through an uplink.
+type raceAttempt struct {
+	uplink  string
+	address string
+}
+
+// raceResult is the outcome of a raceAttempt.
+type raceResult struct {
+	conn    net.Conn
+	attempt raceAttempt
+	err     error
+}
+
+// DialRace races connection attempts to the address over the uplinks and,
+// for hostnames, over their IPv4 and IPv6 addresses (Happy Eyeballs, RFC
+// 8305). If addrs is not empty, they are the host's addresses, already
+// resolved, and each is tried instead of looking the host up. A new attempt
+// starts every delay, or as soon as one fails. The first connection
+// established is returned with the uplink it used; the other attempts are
+// cancelled. If every attempt failed because its uplink was unavailable,
+// the error wraps ErrInterfaceUnavailable.
+func (id *InterfaceDialer) DialRace(ctx context.Context, network, address string, addrs []netip.Addr, uplinks []string, delay time.Duration) (net.Conn, string, error) {
+	if len(uplinks) == 0 {
+		return nil, "", fmt.Errorf("failed to dial %s: %w: no interfaces to race", address, ErrInterfaceUnavailable)
+	}
+	if delay <= 0 {
+		delay = config.DefaultRaceDelay
+	}
+
+	attempts, err := id.raceAttempts(ctx, address, addrs, uplinks)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(attempts))
+	next, pending := 0, 0
+	start := func() {
+		a := attempts[next]
+		next++
+		pending++
+		go func() {
+			conn, err := id.DialContext(ctx, network, a.address, a.uplink)
+			results <- raceResult{conn: conn, attempt: a, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancel()
+				go closeLosers(results, pending)
+				logging.Debug("Race won",
+					"address", address,
+					"interface", res.attempt.uplink,
+					"remote", res.attempt.address,
+					"attempts", next,
+				)
+				return res.conn, res.attempt.uplink, nil
+			}
+			errs = append(errs, res.err)
+			if next < len(attempts) {
+				start()
+				timer.Reset(delay)
+			}
+
+		case <-timer.C:
+			if next < len(attempts) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return nil, "", raceError(address, errs)
+}
+
+// raceAttempts lists the attempts of a race in the order they start. For
+// hostnames, each uplink resolves the host through its own nameservers and
+// gets one attempt per IP family; with resolved addresses, every uplink gets
+// one attempt per address. Families alternate between uplinks so the first
+// attempts cover every uplink and both families. Uplinks whose lookup fails
+// are left out of the race.
+func (id *InterfaceDialer) raceAttempts(ctx context.Context, address string, addrs []netip.Addr, uplinks []string) ([]raceAttempt, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([][]string, len(uplinks))
+	errs := make([]error, len(uplinks))
+	if len(addrs) > 0 {
+		resolved := addrTargets(addrs, port)
+		for i := range uplinks {
+			targets[i] = resolved
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		for i := range uplinks {
+			targets[i] = []string{address}
+		}
+	} else {
+		var wg sync.WaitGroup
+		for i, uplink := range uplinks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				addrs, err := id.LookupIPAddr(ctx, uplink, host)
+				targets[i], errs[i] = familyTargets(addrs, port), err
+			}()
+		}
+		wg.Wait()
+	}
+
+	rounds := 0
+	for _, t := range targets {
+		rounds = max(rounds, len(t))
+	}
+	var attempts []raceAttempt
+	for round := range rounds {
+		for i, uplink := range uplinks {
+			if round < len(targets[i]) {
+				attempts = append(attempts, raceAttempt{
+					uplink:  uplink,
+					address: targets[i][(round+i)%len(targets[i])],
+				})
+			}
+		}
+	}
+	if len(attempts) == 0 {
+		return nil, raceError(address, errs)
+	}
+	return attempts, nil
+}
+
+// familyTargets returns the first IPv6 and first IPv4 address as host:port
+// targets, IPv6 first as RFC 8305 recommends.
+func familyTargets(addrs []net.IPAddr, port string) []string {
+	var v4, v6 string
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if v4 == "" {
+				v4 = net.JoinHostPort(addr.IP.String(), port)
+			}
+		} else if v6 == "" {
+			v6 = net.JoinHostPort(addr.IP.String(), port)
+		}
+	}
+
+	var targets []string
+	for _, t := range []string{v6, v4} {
+		if t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// addrTargets returns the addresses as host:port targets, alternating
+// between IPv6 and IPv4 from IPv6 as RFC 8305 recommends, and otherwise in
+// order.
+func addrTargets(addrs []netip.Addr, port string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		target := net.JoinHostPort(addr.String(), port)
+		if addr.Unmap().Is4() {
+			v4 = append(v4, target)
+		} else {
+			v6 = append(v6, target)
+		}
+	}
+
+	targets := make([]string, 0, len(addrs))
+	for i := range max(len(v4), len(v6)) {
+		if i < len(v6) {
+			targets = append(targets, v6[i])
+		}
+		if i < len(v4) {
+			targets = append(targets, v4[i])
+		}
+	}
+	return targets
+}
+
+// closeLosers closes connections from attempts still pending when a race
+// was won.
+func closeLosers(results <-chan raceResult, pending int) {
+	for range pending {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// raceError combines the errors of a failed race. It wraps
+// ErrInterfaceUnavailable only if every attempt failed for that reason.
+func raceError(address string, errs []error) error {
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrInterfaceUnavailable) {
+			return fmt.Errorf("all attempts to dial %s failed: %v", address, errors.Join(errs...))
+		}
+	}
+	return fmt.Errorf("all attempts to dial %s failed: %w", address, errors.Join(errs...))
+}
@@ -0,0 +1,32 @@
+package network
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestRaceAttemptsResolved(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+	id := NewInterfaceDialer(nil, 0)
+	attempts, err := id.raceAttempts(t.Context(), "example.com:443", addrs, []string{"cable", "wifi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []raceAttempt{
+		{"cable", "[2001:db8::1]:443"},
+		{"wifi", "192.0.2.1:443"},
+		{"cable", "192.0.2.1:443"},
+		{"wifi", "192.0.2.2:443"},
+		{"cable", "192.0.2.2:443"},
+		{"wifi", "[2001:db8::1]:443"},
+	}
+	if !slices.Equal(attempts, want) {
+		t.Fatalf("attempts = %v, want %v", attempts, want)
+	}
+}
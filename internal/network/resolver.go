@@ -2,9 +2,15 @@ package network
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/waylen888/splitdial/internal/config"
 	"github.com/waylen888/splitdial/internal/logging"
@@ -12,6 +18,7 @@ import (
 
 // InterfaceResolver resolves interface specifications to device names.
 type InterfaceResolver struct {
+	mu sync.Mutex
 	// Cache of hardware port to device name mappings
 	portToDevice map[string]string
 }
@@ -26,7 +33,25 @@ func NewInterfaceResolver() *InterfaceResolver {
 // ResolveDeviceName resolves an InterfaceSpec to an actual device name.
 // If Device is specified, it returns that directly.
 // If HardwarePort is specified, it queries macOS networksetup to find the device.
+// Otherwise the device matching all of the spec's selectors is returned.
+// If none of these resolve and Detect is set, the best auto-detected
+// interface of that kind is used.
 func (r *InterfaceResolver) ResolveDeviceName(spec config.InterfaceSpec) (string, error) {
+	device, err := r.resolveSpec(spec)
+	if err == nil || spec.Detect == "" {
+		return device, err
+	}
+
+	detected, detectErr := detectDevice(spec.Detect)
+	if detectErr != nil {
+		return "", fmt.Errorf("%v; auto-detect: %w", err, detectErr)
+	}
+	logging.Info("Auto-detected interface", "kind", spec.Detect, "device", detected, "reason", err)
+	return detected, nil
+}
+
+// resolveSpec resolves the explicit identifiers of a spec.
+func (r *InterfaceResolver) resolveSpec(spec config.InterfaceSpec) (string, error) {
 	// If device is directly specified, use it
 	if spec.Device != "" {
 		return spec.Device, nil
@@ -34,13 +59,155 @@ func (r *InterfaceResolver) ResolveDeviceName(spec config.InterfaceSpec) (string
 
 	// If hardware port is specified, resolve it
 	if spec.HardwarePort != "" {
+		if runtime.GOOS != "darwin" {
+			return "", fmt.Errorf("hardware_port is only supported on macOS; use mac, driver, bus_path, path_name or name instead")
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
 		return r.resolveHardwarePort(spec.HardwarePort)
 	}
 
-	return "", fmt.Errorf("interface spec has neither device nor hardware_port specified")
+	if spec.HasSelectors() {
+		return resolveSelectors(spec)
+	}
+
+	return "", fmt.Errorf("interface spec has no device, hardware_port or selector specified")
+}
+
+// resolveSelectors returns the device matching all selectors in the spec.
+// If several devices match, links that are up are preferred, then the
+// first in system (interface index) order.
+func resolveSelectors(spec config.InterfaceSpec) (string, error) {
+	ifaces, err := scanInterfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var best *Interface
+	for i := range ifaces {
+		iface := &ifaces[i]
+		ok, err := matchSelectors(spec, iface)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		if best == nil || (linkUp(*iface) && !linkUp(*best)) {
+			best = iface
+		}
+	}
+
+	if best == nil {
+		return "", fmt.Errorf("no interface matches %s", describeSelectors(spec))
+	}
+	return best.Name, nil
+}
+
+// matchSelectors reports whether the interface matches every selector set
+// in the spec.
+func matchSelectors(spec config.InterfaceSpec, iface *Interface) (bool, error) {
+	if spec.Name != "" {
+		matched, err := filepath.Match(spec.Name, iface.Name)
+		if err != nil {
+			return false, fmt.Errorf("invalid name pattern %q: %w", spec.Name, err)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if spec.MAC != "" {
+		want, err := net.ParseMAC(spec.MAC)
+		if err != nil {
+			return false, fmt.Errorf("invalid mac %q: %w", spec.MAC, err)
+		}
+		if !strings.EqualFold(want.String(), iface.MACAddress) {
+			return false, nil
+		}
+	}
+
+	if spec.Driver != "" {
+		driver, err := sysfsDriver(iface.Name)
+		if err != nil || driver != spec.Driver {
+			return false, ignoreMissing(err)
+		}
+	}
+
+	if spec.BusPath != "" {
+		busPath, err := sysfsBusPath(iface.Name)
+		if err != nil || !matchBusPath(spec.BusPath, busPath) {
+			return false, ignoreMissing(err)
+		}
+	}
+
+	if spec.PathName != "" {
+		pathName, err := udevProperty(iface.Name, "ID_NET_NAME_PATH")
+		if err != nil || pathName != spec.PathName {
+			return false, ignoreMissing(err)
+		}
+	}
+
+	return true, nil
+}
+
+// matchBusPath reports whether a sysfs device path matches the pattern,
+// either exactly or as a glob, in whole or in its trailing path components.
+func matchBusPath(pattern, busPath string) bool {
+	for path := busPath; path != ""; {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		i := strings.IndexByte(path, '/')
+		if i < 0 {
+			break
+		}
+		path = path[i+1:]
+	}
+	return false
+}
+
+// ignoreMissing drops errors caused by an interface lacking the queried
+// attribute (e.g., virtual devices have no driver), so it simply does not
+// match. Other errors, such as an unsupported platform, are returned.
+func ignoreMissing(err error) error {
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// describeSelectors formats the spec's selectors for error messages.
+func describeSelectors(spec config.InterfaceSpec) string {
+	var parts []string
+	if spec.MAC != "" {
+		parts = append(parts, fmt.Sprintf("mac=%s", spec.MAC))
+	}
+	if spec.Driver != "" {
+		parts = append(parts, fmt.Sprintf("driver=%s", spec.Driver))
+	}
+	if spec.BusPath != "" {
+		parts = append(parts, fmt.Sprintf("bus_path=%s", spec.BusPath))
+	}
+	if spec.PathName != "" {
+		parts = append(parts, fmt.Sprintf("path_name=%s", spec.PathName))
+	}
+	if spec.Name != "" {
+		parts = append(parts, fmt.Sprintf("name=%s", spec.Name))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Invalidate clears cached mappings so the next resolution queries the
+// system again, e.g. after an adapter was reconnected.
+func (r *InterfaceResolver) Invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.portToDevice = make(map[string]string)
 }
 
 // resolveHardwarePort resolves a hardware port name to its device name.
+// The caller must hold r.mu.
 func (r *InterfaceResolver) resolveHardwarePort(portName string) (string, error) {
 	// Check cache first
 	if device, ok := r.portToDevice[portName]; ok {
@@ -113,6 +280,9 @@ func parseNetworkSetupOutput(output string) map[string]string {
 
 // GetAllPorts returns all available hardware ports and their device mappings.
 func (r *InterfaceResolver) GetAllPorts() (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if err := r.refreshPortMappings(); err != nil {
 		return nil, err
 	}
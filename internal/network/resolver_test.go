@@ -0,0 +1,90 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+func TestMatchBusPath(t *testing.T) {
+	const usb = "pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0"
+	const pci = "pci0000:00/0000:00:1c.0/0000:03:00.0"
+
+	tests := []struct {
+		pattern string
+		busPath string
+		want    bool
+	}{
+		// Exact
+		{usb, usb, true},
+		{pci, pci, true},
+		// Trailing components
+		{"usb2/2-1/2-1:1.0", usb, true},
+		{"2-1:1.0", usb, true},
+		{"0000:03:00.0", pci, true},
+		// Globs, over the whole path or its trailing components
+		{"pci0000:00/*/usb2/2-1/*", usb, true},
+		{"*/usb2/2-1/*", usb, true},
+		{"usb2/*/*", usb, true},
+		{"0000:0?:00.0", pci, true},
+		{"pci0000:00/0000:00:1c.0/*", pci, true},
+
+		// Part of a component
+		{"1:1.0", usb, false},
+		{"3:00.0", pci, false},
+		// Leading or middle components only
+		{"pci0000:00/0000:00:14.0", usb, false},
+		{"usb2/2-1", usb, false},
+		{"usb2/*", usb, false},
+		// A glob doesn't cross path separators
+		{"pci0000:00/*", usb, false},
+		// Another device
+		{"usb1/1-1/1-1:1.0", usb, false},
+		{"0000:04:00.0", pci, false},
+		// Malformed glob
+		{"usb2/[2-1", usb, false},
+		// No device path (virtual interfaces)
+		{"*", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchBusPath(tt.pattern, tt.busPath); got != tt.want {
+			t.Errorf("matchBusPath(%q, %q) = %v, want %v", tt.pattern, tt.busPath, got, tt.want)
+		}
+	}
+}
+
+func TestMatchSelectors(t *testing.T) {
+	iface := &Interface{Name: "enp3s0", MACAddress: "00:1a:2b:3c:4d:5e"}
+
+	tests := []struct {
+		name    string
+		spec    config.InterfaceSpec
+		want    bool
+		wantErr bool
+	}{
+		{name: "name", spec: config.InterfaceSpec{Name: "enp3s0"}, want: true},
+		{name: "name glob", spec: config.InterfaceSpec{Name: "enp*"}, want: true},
+		{name: "other name", spec: config.InterfaceSpec{Name: "wl*"}},
+		{name: "bad name glob", spec: config.InterfaceSpec{Name: "enp[3"}, wantErr: true},
+		{name: "mac", spec: config.InterfaceSpec{MAC: "00:1a:2b:3c:4d:5e"}, want: true},
+		{name: "mac uppercase", spec: config.InterfaceSpec{MAC: "00:1A:2B:3C:4D:5E"}, want: true},
+		{name: "mac dashes", spec: config.InterfaceSpec{MAC: "00-1a-2b-3c-4d-5e"}, want: true},
+		{name: "other mac", spec: config.InterfaceSpec{MAC: "00:1a:2b:3c:4d:5f"}},
+		{name: "bad mac", spec: config.InterfaceSpec{MAC: "00:1a:2b"}, wantErr: true},
+		{name: "all selectors", spec: config.InterfaceSpec{Name: "en*", MAC: "00:1a:2b:3c:4d:5e"}, want: true},
+		{name: "one selector fails", spec: config.InterfaceSpec{Name: "wl*", MAC: "00:1a:2b:3c:4d:5e"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchSelectors(tt.spec, iface)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchSelectors() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("matchSelectors() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
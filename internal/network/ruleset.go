@@ -0,0 +1,325 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+const (
+	ruleSetFetchTimeout = time.Minute
+	maxRuleSetSize      = 64 << 20
+
+	// ruleSetRetryInterval is the delay before retrying a failed download,
+	// unless the rule set's interval is shorter.
+	ruleSetRetryInterval = 5 * time.Minute
+)
+
+// RuleSetFetchStatus is the download state of a remote rule set.
+type RuleSetFetchStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Interface   string    `json:"interface,omitempty"`
+	LastFetch   time.Time `json:"last_fetch,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastChange  time.Time `json:"last_change,omitzero"` // last download that changed the content
+	LastError   string    `json:"last_error,omitempty"`
+	NextFetch   time.Time `json:"next_fetch"`
+}
+
+// ruleSetCache holds the validators of a cached download, stored next to
+// the cache file so conditional requests survive restarts.
+type ruleSetCache struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// RuleSetUpdater periodically downloads remote rule sets to their cache
+// files, through the configured interface.
+type RuleSetUpdater struct {
+	dialer *InterfaceDialer
+
+	mu       sync.Mutex
+	sets     map[string]config.RemoteRuleSet
+	status   map[string]*RuleSetFetchStatus
+	onUpdate func()
+	wake     chan struct{}
+}
+
+// NewRuleSetUpdater creates a rule-set updater that downloads through the dialer.
+func NewRuleSetUpdater(dialer *InterfaceDialer) *RuleSetUpdater {
+	return &RuleSetUpdater{
+		dialer: dialer,
+		sets:   make(map[string]config.RemoteRuleSet),
+		status: make(map[string]*RuleSetFetchStatus),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// SetOnUpdate sets the function called after a download changed a cache file.
+func (u *RuleSetUpdater) SetOnUpdate(onUpdate func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.onUpdate = onUpdate
+}
+
+// Configure sets the rule sets to download. New rule sets, and those whose
+// URL, interface or cache path changed, are downloaded right away. It can be
+// called again on config reload.
+func (u *RuleSetUpdater) Configure(sets []config.RemoteRuleSet) {
+	u.mu.Lock()
+	next := make(map[string]config.RemoteRuleSet, len(sets))
+	for _, rs := range sets {
+		next[rs.Name] = rs
+		st, ok := u.status[rs.Name]
+		if prev := u.sets[rs.Name]; !ok || prev.URL != rs.URL || prev.Interface != rs.Interface || prev.Path != rs.Path {
+			u.status[rs.Name] = &RuleSetFetchStatus{Name: rs.Name, URL: rs.URL, Interface: rs.Interface, NextFetch: time.Now()}
+		} else if rs.Interval != prev.Interval && !st.LastSuccess.IsZero() {
+			st.NextFetch = st.LastSuccess.Add(rs.Interval)
+		}
+	}
+	for name := range u.status {
+		if _, ok := next[name]; !ok {
+			delete(u.status, name)
+		}
+	}
+	u.sets = next
+	u.mu.Unlock()
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the download loop until the context is cancelled.
+func (u *RuleSetUpdater) Start(ctx context.Context) {
+	for {
+		u.fetchDue(ctx)
+
+		wait := time.Hour
+		u.mu.Lock()
+		for _, st := range u.status {
+			wait = min(wait, time.Until(st.NextFetch))
+		}
+		u.mu.Unlock()
+
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-u.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Status returns the download state of every remote rule set.
+func (u *RuleSetUpdater) Status() map[string]RuleSetFetchStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	result := make(map[string]RuleSetFetchStatus, len(u.status))
+	for name, st := range u.status {
+		result[name] = *st
+	}
+	return result
+}
+
+// fetchDue downloads the rule sets whose next fetch time has passed, and
+// calls the update function if any cache file changed.
+func (u *RuleSetUpdater) fetchDue(ctx context.Context) {
+	u.mu.Lock()
+	var due []config.RemoteRuleSet
+	for name, st := range u.status {
+		if !time.Now().Before(st.NextFetch) {
+			due = append(due, u.sets[name])
+		}
+	}
+	u.mu.Unlock()
+
+	changed := false
+	for _, rs := range due {
+		updated, err := u.fetch(ctx, rs)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.Warn("Failed to update rule set", "name", rs.Name, "url", rs.URL, "interface", rs.Interface, "error", err)
+		} else if updated {
+			logging.Info("Rule set downloaded", "name", rs.Name, "url", rs.URL)
+		} else {
+			logging.Debug("Rule set not modified", "name", rs.Name, "url", rs.URL)
+		}
+		changed = changed || updated
+		u.record(rs, updated, err)
+	}
+
+	u.mu.Lock()
+	onUpdate := u.onUpdate
+	u.mu.Unlock()
+	if changed && onUpdate != nil {
+		onUpdate()
+	}
+}
+
+// record updates a rule set's status with a download result.
+func (u *RuleSetUpdater) record(rs config.RemoteRuleSet, updated bool, fetchErr error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	st, ok := u.status[rs.Name]
+	if !ok || u.sets[rs.Name] != rs {
+		// Reconfigured during the download
+		return
+	}
+	now := time.Now()
+	st.LastFetch = now
+	if fetchErr != nil {
+		st.LastError = fetchErr.Error()
+		st.NextFetch = now.Add(min(rs.Interval, ruleSetRetryInterval))
+		return
+	}
+	st.LastError = ""
+	st.LastSuccess = now
+	if updated {
+		st.LastChange = now
+	}
+	st.NextFetch = now.Add(rs.Interval)
+}
+
+// fetch downloads a rule set to its cache file with a conditional request,
+// and reports whether the cache file changed. A download that fails or has
+// no valid entries leaves the cache file as it was.
+func (u *RuleSetUpdater) fetch(ctx context.Context, rs config.RemoteRuleSet) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, ruleSetFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rs.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	cache := readRuleSetCache(rs.Path)
+	if _, err := os.Stat(rs.Path); err == nil {
+		if cache.ETag != "" {
+			req.Header.Set("If-None-Match", cache.ETag)
+		}
+		if cache.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cache.LastModified)
+		}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if rs.Interface == "" {
+					return u.dialer.DialDefaultContext(ctx, network, addr)
+				}
+				return u.dialer.DialContext(ctx, network, addr, rs.Interface)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRuleSetSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(data) > maxRuleSetSize {
+		return false, fmt.Errorf("rule set is larger than %d bytes", maxRuleSetSize)
+	}
+	parsed, err := config.ParseRuleSet(bytes.NewReader(data), rs.Format)
+	if err != nil {
+		return false, err
+	}
+	if len(parsed.Domains) == 0 && len(parsed.IPs) == 0 && parsed.InvalidLines > 0 {
+		// Likely an error page rather than a rule set
+		return false, fmt.Errorf("no valid entries in %s format: %s", rs.Format, parsed.Errors[0])
+	}
+
+	if old, err := os.ReadFile(rs.Path); err == nil && bytes.Equal(old, data) {
+		return false, writeRuleSetCache(rs.Path, resp.Header)
+	}
+	if err := writeFileAtomic(rs.Path, data); err != nil {
+		return false, err
+	}
+	return true, writeRuleSetCache(rs.Path, resp.Header)
+}
+
+// ruleSetCachePath returns the path of the validators stored for a cache file.
+func ruleSetCachePath(path string) string {
+	return path + ".meta"
+}
+
+// readRuleSetCache reads the validators stored for a cache file; a missing
+// or unreadable file yields none.
+func readRuleSetCache(path string) ruleSetCache {
+	var cache ruleSetCache
+	if data, err := os.ReadFile(ruleSetCachePath(path)); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+// writeRuleSetCache stores the validators of a download's response.
+func writeRuleSetCache(path string, header http.Header) error {
+	data, err := json.Marshal(ruleSetCache{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ruleSetCachePath(path), data)
+}
+
+// writeFileAtomic replaces a file by renaming a temporary file over it, so
+// readers never see a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
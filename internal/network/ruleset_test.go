@@ -0,0 +1,130 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+const testRuleSet = "example.com\n*.example.org\n"
+
+// ruleSetServer serves testRuleSet with validators, answering conditional
+// requests with 304, until fail is set to another status.
+type ruleSetServer struct {
+	*httptest.Server
+	fail        atomic.Int32 // status to return instead, 0 for none
+	truncate    atomic.Bool  // declare a longer body than sent
+	conditional atomic.Int32 // conditional requests seen
+}
+
+func newRuleSetServer(t *testing.T) *ruleSetServer {
+	s := &ruleSetServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := s.fail.Load(); status != 0 {
+			http.Error(w, "unavailable", int(status))
+			return
+		}
+		if s.truncate.Load() {
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("truncated.example\n"))
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 05 Oct 2026 10:00:00 GMT")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			s.conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(testRuleSet))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testRemoteRuleSet(t *testing.T, url string) config.RemoteRuleSet {
+	return config.RemoteRuleSet{
+		Name:     "test",
+		URL:      url,
+		Interval: time.Hour,
+		Format:   config.RuleSetDomains,
+		Path:     filepath.Join(t.TempDir(), "rule_sets", "test"),
+	}
+}
+
+func TestRuleSetFetchNotModified(t *testing.T) {
+	srv := newRuleSetServer(t)
+	rs := testRemoteRuleSet(t, srv.URL)
+	u := NewRuleSetUpdater(NewInterfaceDialer(nil, 0))
+
+	updated, err := u.fetch(t.Context(), rs)
+	if err != nil || !updated {
+		t.Fatalf("first fetch = %v, %v; want true, nil", updated, err)
+	}
+	if data, _ := os.ReadFile(rs.Path); string(data) != testRuleSet {
+		t.Fatalf("cache file = %q, want %q", data, testRuleSet)
+	}
+
+	updated, err = u.fetch(t.Context(), rs)
+	if err != nil || updated {
+		t.Fatalf("second fetch = %v, %v; want false, nil", updated, err)
+	}
+	if n := srv.conditional.Load(); n != 1 {
+		t.Fatalf("conditional requests = %d, want 1", n)
+	}
+}
+
+func TestRuleSetFetchKeepsLastGoodCopy(t *testing.T) {
+	srv := newRuleSetServer(t)
+	rs := testRemoteRuleSet(t, srv.URL)
+	u := NewRuleSetUpdater(NewInterfaceDialer(nil, 0))
+	if _, err := u.fetch(t.Context(), rs); err != nil {
+		t.Fatal(err)
+	}
+	// Drop the validators so the server sends the body again
+	if err := os.Remove(ruleSetCachePath(rs.Path)); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.fail.Store(http.StatusBadGateway)
+	if updated, err := u.fetch(t.Context(), rs); err == nil || updated {
+		t.Fatalf("fetch with 502 = %v, %v; want an error", updated, err)
+	}
+	srv.fail.Store(0)
+	srv.truncate.Store(true)
+	if updated, err := u.fetch(t.Context(), rs); err == nil || updated {
+		t.Fatalf("fetch with truncated body = %v, %v; want an error", updated, err)
+	}
+
+	if data, _ := os.ReadFile(rs.Path); string(data) != testRuleSet {
+		t.Fatalf("cache file = %q, want the last good copy", data)
+	}
+}
+
+func TestRuleSetValidatorsPersist(t *testing.T) {
+	srv := newRuleSetServer(t)
+	rs := testRemoteRuleSet(t, srv.URL)
+	if _, err := NewRuleSetUpdater(NewInterfaceDialer(nil, 0)).fetch(t.Context(), rs); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := readRuleSetCache(rs.Path)
+	if cache.ETag != `"v1"` || cache.LastModified != "Mon, 05 Oct 2026 10:00:00 GMT" {
+		t.Fatalf("stored validators = %+v", cache)
+	}
+
+	// A new updater, as after a restart, sends the stored validators
+	updated, err := NewRuleSetUpdater(NewInterfaceDialer(nil, 0)).fetch(t.Context(), rs)
+	if err != nil || updated {
+		t.Fatalf("fetch after restart = %v, %v; want false, nil", updated, err)
+	}
+	if n := srv.conditional.Load(); n != 1 {
+		t.Fatalf("conditional requests = %d, want 1", n)
+	}
+}
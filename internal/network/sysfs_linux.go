@@ -0,0 +1,65 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sysClassNet = "/sys/class/net"
+	sysDevices  = "/sys/devices/"
+	udevDataDir = "/run/udev/data"
+)
+
+// sysfsDriver returns the name of the kernel driver bound to the device.
+func sysfsDriver(device string) (string, error) {
+	target, err := os.Readlink(filepath.Join(sysClassNet, device, "device", "driver"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// sysfsBusPath returns the device's sysfs path relative to /sys/devices,
+// e.g. "pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0".
+func sysfsBusPath(device string) (string, error) {
+	path, err := filepath.EvalSymlinks(filepath.Join(sysClassNet, device, "device"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path, sysDevices), nil
+}
+
+// udevProperty returns a property udev recorded for the device, such as
+// ID_NET_NAME_PATH.
+func udevProperty(device, key string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, device, "ifindex"))
+	if err != nil {
+		return "", err
+	}
+	ifindex := strings.TrimSpace(string(data))
+
+	f, err := os.Open(filepath.Join(udevDataDir, "n"+ifindex))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	prefix := "E:" + key + "="
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("udev property %s for %s: %w", key, device, fs.ErrNotExist)
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package network
+
+import "errors"
+
+var errSysfsUnsupported = errors.New("driver, bus_path and path_name selectors are only supported on Linux")
+
+// sysfsDriver is not available on this platform.
+func sysfsDriver(device string) (string, error) {
+	return "", errSysfsUnsupported
+}
+
+// sysfsBusPath is not available on this platform.
+func sysfsBusPath(device string) (string, error) {
+	return "", errSysfsUnsupported
+}
+
+// udevProperty is not available on this platform.
+func udevProperty(device, key string) (string, error) {
+	return "", errSysfsUnsupported
+}
@@ -0,0 +1,283 @@
+package network
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+// Interface event types.
+const (
+	EventAdded         = "added"          // a device appeared
+	EventRemoved       = "removed"        // a device disappeared
+	EventUp            = "up"             // a link came up (admin up with carrier)
+	EventDown          = "down"           // a link went down
+	EventAddrAdded     = "addr_added"     // addresses were assigned to a device
+	EventAddrRemoved   = "addr_removed"   // addresses were removed from a device
+	EventUplinkChanged = "uplink_changed" // an uplink was re-resolved to a different device
+)
+
+// InterfaceEvent describes a change to a network interface.
+type InterfaceEvent struct {
+	Type   string    `json:"type"`
+	Device string    `json:"device"`
+	Uplink string    `json:"uplink,omitempty"` // configured uplink name, if known
+	Addrs  []string  `json:"addrs,omitempty"`  // addresses added or removed
+	Time   time.Time `json:"time"`
+}
+
+// InterfaceWatcher keeps a cached snapshot of the system's interfaces and
+// emits events when links go up or down or their addresses change. On Linux
+// it is driven by netlink notifications; elsewhere it polls.
+type InterfaceWatcher struct {
+	pollInterval time.Duration
+
+	mu           sync.RWMutex
+	snapshot     map[string]Interface
+	subscribers  map[chan InterfaceEvent]struct{}
+	uplinkLookup func(device string) string
+
+	refresh chan struct{}
+}
+
+// NewInterfaceWatcher creates a watcher and takes an initial snapshot.
+// pollInterval is how often interfaces are rescanned when change
+// notifications are unavailable.
+func NewInterfaceWatcher(pollInterval time.Duration) *InterfaceWatcher {
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
+	w := &InterfaceWatcher{
+		pollInterval: pollInterval,
+		snapshot:     make(map[string]Interface),
+		subscribers:  make(map[chan InterfaceEvent]struct{}),
+		refresh:      make(chan struct{}, 1),
+	}
+	w.rescan(false)
+	return w
+}
+
+// Start watches for interface changes until the context is cancelled.
+func (w *InterfaceWatcher) Start(ctx context.Context) {
+	interval := w.pollInterval
+	notifyDone, err := watchLinkChanges(ctx, w.Refresh)
+	if err != nil {
+		logging.Warn("Interface change notifications unavailable, polling instead", "interval", w.pollInterval, "error", err)
+	} else {
+		// Notifications drive updates; poll occasionally as a safety net
+		interval = 6 * w.pollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-notifyDone:
+			if ctx.Err() != nil {
+				return
+			}
+			// Notifications stopped; fall back to polling at the base rate
+			logging.Warn("Interface change notifications stopped, polling instead", "interval", w.pollInterval)
+			notifyDone = nil
+			ticker.Reset(w.pollInterval)
+			w.rescan(true)
+		case <-ticker.C:
+			w.rescan(true)
+		case <-w.refresh:
+			// Coalesce bursts of notifications (a link change usually
+			// produces several address messages)
+			time.Sleep(200 * time.Millisecond)
+			select {
+			case <-w.refresh:
+			default:
+			}
+			w.rescan(true)
+		}
+	}
+}
+
+// SetUplinkLookup sets the function used to annotate events with the
+// configured uplink name of their device.
+func (w *InterfaceWatcher) SetUplinkLookup(lookup func(device string) string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.uplinkLookup = lookup
+}
+
+// Refresh requests an immediate rescan.
+func (w *InterfaceWatcher) Refresh() {
+	select {
+	case w.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Snapshot returns the cached interfaces, sorted by name.
+func (w *InterfaceWatcher) Snapshot() []Interface {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	result := make([]Interface, 0, len(w.snapshot))
+	for _, iface := range w.snapshot {
+		result = append(result, iface)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Subscribe returns a channel receiving interface events and a function to
+// cancel the subscription. Events are dropped for slow subscribers.
+func (w *InterfaceWatcher) Subscribe() (<-chan InterfaceEvent, func()) {
+	ch := make(chan InterfaceEvent, 64)
+
+	w.mu.Lock()
+	w.subscribers[ch] = struct{}{}
+	w.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subscribers, ch)
+			w.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends an event to all subscribers.
+func (w *InterfaceWatcher) Publish(ev InterfaceEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if ev.Uplink == "" && w.uplinkLookup != nil {
+		ev.Uplink = w.uplinkLookup(ev.Device)
+	}
+	for ch := range w.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// rescan takes a new snapshot and, if publish is set, emits events for the
+// differences from the previous one.
+func (w *InterfaceWatcher) rescan(publish bool) {
+	ifaces, err := scanInterfaces()
+	if err != nil {
+		logging.Warn("Failed to scan interfaces", "error", err)
+		return
+	}
+
+	next := make(map[string]Interface, len(ifaces))
+	for _, iface := range ifaces {
+		next[iface.Name] = iface
+	}
+
+	w.mu.Lock()
+	prev := w.snapshot
+	w.snapshot = next
+	w.mu.Unlock()
+
+	if !publish {
+		return
+	}
+	for _, ev := range diffInterfaces(prev, next) {
+		w.Publish(ev)
+	}
+}
+
+// diffInterfaces returns the events that turn prev into next.
+func diffInterfaces(prev, next map[string]Interface) []InterfaceEvent {
+	now := time.Now()
+	var events []InterfaceEvent
+
+	names := make([]string, 0, len(prev)+len(next))
+	for name := range prev {
+		names = append(names, name)
+	}
+	for name := range next {
+		if _, ok := prev[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		old, hadOld := prev[name]
+		cur, hasCur := next[name]
+
+		switch {
+		case !hasCur:
+			events = append(events, InterfaceEvent{Type: EventRemoved, Device: name, Time: now})
+			continue
+		case !hadOld:
+			events = append(events, InterfaceEvent{Type: EventAdded, Device: name, Addrs: interfaceAddrs(cur), Time: now})
+			continue
+		}
+
+		if linkUp(old) != linkUp(cur) {
+			evType := EventDown
+			if linkUp(cur) {
+				evType = EventUp
+			}
+			events = append(events, InterfaceEvent{Type: evType, Device: name, Time: now})
+		}
+
+		added, removed := diffAddrs(interfaceAddrs(old), interfaceAddrs(cur))
+		if len(added) > 0 {
+			events = append(events, InterfaceEvent{Type: EventAddrAdded, Device: name, Addrs: added, Time: now})
+		}
+		if len(removed) > 0 {
+			events = append(events, InterfaceEvent{Type: EventAddrRemoved, Device: name, Addrs: removed, Time: now})
+		}
+	}
+
+	return events
+}
+
+// linkUp reports whether the interface is administratively up with carrier.
+func linkUp(iface Interface) bool {
+	return iface.IsUp && iface.IsRunning
+}
+
+// interfaceAddrs returns all IPv4 and IPv6 addresses of the interface.
+func interfaceAddrs(iface Interface) []string {
+	addrs := make([]string, 0, len(iface.IPv4Addrs)+len(iface.IPv6Addrs))
+	addrs = append(addrs, iface.IPv4Addrs...)
+	return append(addrs, iface.IPv6Addrs...)
+}
+
+// diffAddrs returns the addresses only in next (added) and only in prev (removed).
+func diffAddrs(prev, next []string) (added, removed []string) {
+	inPrev := make(map[string]bool, len(prev))
+	for _, a := range prev {
+		inPrev[a] = true
+	}
+	inNext := make(map[string]bool, len(next))
+	for _, a := range next {
+		inNext[a] = true
+		if !inPrev[a] {
+			added = append(added, a)
+		}
+	}
+	for _, a := range prev {
+		if !inNext[a] {
+			removed = append(removed, a)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+// rtnetlink multicast groups (linux/rtnetlink.h); not exported by syscall.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// watchLinkChanges subscribes to rtnetlink link and address notifications
+// and calls notify whenever one arrives. It returns once the subscription is
+// set up; notifications are read in the background until ctx is cancelled
+// or the socket fails, after which the returned channel is closed.
+func watchLinkChanges(ctx context.Context, notify func()) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	// Wake up periodically so cancellation is noticed
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set netlink timeout: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*1024)
+
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+					continue
+				}
+				if errors.Is(err, syscall.ENOBUFS) {
+					// Notifications were dropped; rescan to catch up
+					notify()
+					continue
+				}
+				logging.Warn("Netlink receive failed", "error", err)
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+					notify()
+				}
+			}
+		}
+	}()
+
+	return done, nil
+}
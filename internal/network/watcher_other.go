@@ -0,0 +1,13 @@
+//go:build !linux
+
+package network
+
+import (
+	"context"
+	"errors"
+)
+
+// watchLinkChanges is not implemented on this platform; the watcher polls.
+func watchLinkChanges(ctx context.Context, notify func()) (<-chan struct{}, error) {
+	return nil, errors.New("link change notifications are only supported on Linux")
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+// errRejectedByPolicy is returned when a connection is refused because its
+// interface is down and the on_interface_down policy is "reject".
+var errRejectedByPolicy = errors.New("rejected by on_interface_down policy")
+
+// dialRoute connects to target through the routed interface. If that
+// interface is unhealthy or unavailable, the route's on_interface_down policy
+// decides whether to use the default route, another interface, or reject.
+func dialRoute(ctx context.Context, dialer *network.InterfaceDialer, result router.RouteResult, target string) (net.Conn, error) {
+	var reason error
+	if result.Unhealthy {
+		reason = fmt.Errorf("interface %s is unhealthy", result.Interface)
+	} else {
+		conn, err := dialPrimary(ctx, dialer, result, target)
+		if err == nil || !errors.Is(err, network.ErrInterfaceUnavailable) {
+			return conn, err
+		}
+		reason = err
+	}
+
+	uplink, err := interfaceDownRoute(result, target, reason)
+	if err != nil {
+		return nil, err
+	}
+	if uplink == "" {
+		return dialer.DialDefaultContext(ctx, "tcp", target)
+	}
+	return dialer.DialContext(ctx, "tcp", target, uplink)
+}
+
+// listenRoute opens a listener on the routed interface for a connection
+// from target, applying the route's on_interface_down policy like dialRoute.
+func listenRoute(ctx context.Context, dialer *network.InterfaceDialer, result router.RouteResult, target string) (net.Listener, error) {
+	var reason error
+	if result.Unhealthy {
+		reason = fmt.Errorf("interface %s is unhealthy", result.Interface)
+	} else {
+		ln, err := dialer.Listen(ctx, result.Interface, target)
+		if err == nil || !errors.Is(err, network.ErrInterfaceUnavailable) {
+			return ln, err
+		}
+		reason = err
+	}
+
+	uplink, err := interfaceDownRoute(result, target, reason)
+	if err != nil {
+		return nil, err
+	}
+	if uplink == "" {
+		return dialer.ListenDefault(ctx, target)
+	}
+	return dialer.Listen(ctx, uplink, target)
+}
+
+// interfaceDownRoute applies the route's on_interface_down policy after its
+// interface failed for reason. It returns the fallback uplink to use, "" for
+// the system default route, or an error wrapping errRejectedByPolicy.
+func interfaceDownRoute(result router.RouteResult, target string, reason error) (string, error) {
+	action, fallbackTo, err := config.ParseInterfaceDownPolicy(result.OnInterfaceDown)
+	if err != nil {
+		return "", err
+	}
+
+	switch action {
+	case config.PolicyReject:
+		logging.Warn("Interface down, rejecting connection",
+			"target", target,
+			"interface", result.Interface,
+			"rule", result.RuleName,
+			"policy", result.OnInterfaceDown,
+			"reason", reason,
+		)
+		return "", fmt.Errorf("%w: %v", errRejectedByPolicy, reason)
+
+	case config.PolicyFallbackTo:
+		logging.Warn("Interface down, using fallback interface",
+			"target", target,
+			"interface", result.Interface,
+			"fallback", fallbackTo,
+			"rule", result.RuleName,
+			"policy", result.OnInterfaceDown,
+			"reason", reason,
+		)
+		return fallbackTo, nil
+
+	default:
+		logging.Warn("Interface down, falling back to default route",
+			"target", target,
+			"interface", result.Interface,
+			"rule", result.RuleName,
+			"policy", config.PolicyFallbackDefault,
+			"reason", reason,
+		)
+		return "", nil
+	}
+}
+
+// dialPrimary connects through the routed interface, or races the route's
+// candidates if it has any. Addresses the route resolved the target to are
+// all tried before the interface counts as down. Connections through
+// load-balanced interfaces are tracked for the balancer's stats.
+func dialPrimary(ctx context.Context, dialer *network.InterfaceDialer, result router.RouteResult, target string) (net.Conn, error) {
+	if len(result.Candidates) > 0 || len(result.Addrs) > 0 {
+		uplinks := result.Candidates
+		if len(uplinks) == 0 {
+			uplinks = []string{result.Interface}
+		}
+		conn, uplink, err := dialer.DialRace(ctx, "tcp", target, result.Addrs, uplinks, result.RaceDelay)
+		if err != nil {
+			for _, name := range uplinks {
+				result.WithInterface(name).Failed()
+			}
+			return nil, err
+		}
+		return newTrackedConn(conn, result.WithInterface(uplink)), nil
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", target, result.Interface)
+	if err != nil {
+		result.Failed()
+		return nil, err
+	}
+	return newTrackedConn(conn, result), nil
+}
+
+// closeWriter is implemented by connections that support half-close.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// trackedConn counts a connection through a load-balanced interface as
+// active for the balancer's stats until it is closed. An upstream connection
+// pooled between HTTP requests is only counted while requests use it.
+type trackedConn struct {
+	net.Conn
+	result router.RouteResult
+
+	mu      sync.Mutex
+	users   int    // requests using the connection, 1 from when it is dialed
+	release func() // nil while the connection is idle or closed
+	closed  bool
+}
+
+// newTrackedConn wraps conn, counting it as a new connection of result.
+func newTrackedConn(conn net.Conn, result router.RouteResult) net.Conn {
+	return &trackedConn{Conn: conn, result: result, users: 1, release: result.Acquire()}
+}
+
+// resume counts the connection as active for another request.
+func (c *trackedConn) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.users++
+	if c.users == 1 {
+		c.release = c.result.Activate()
+	}
+}
+
+// idle ends a request's use of the connection. It stops counting as active
+// once no request uses it.
+func (c *trackedConn) idle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.users == 0 {
+		return
+	}
+	c.users--
+	if c.users == 0 {
+		c.release()
+		c.release = nil
+	}
+}
+
+// Close closes the connection and releases it.
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.release != nil {
+			c.release()
+			c.release = nil
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+// Firewall rule formats accepted by FirewallRules.
+const (
+	FirewallNftables = "nftables"
+	FirewallIptables = "iptables"
+)
+
+// tproxyTable is the policy routing table that delivers TPROXY-marked
+// packets locally.
+const tproxyTable = 100
+
+// Destinations that are never diverted: local, private, link-local and
+// multicast networks.
+var (
+	bypassIPv4 = []string{"0.0.0.0/8", "10.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4"}
+	bypassIPv6 = []string{"::1/128", "fc00::/7", "fe80::/10", "ff00::/8"}
+)
+
+// FirewallRules returns a shell script that diverts TCP traffic to the
+// transparent listener configured in server: the TPROXY listener if set,
+// otherwise the REDIRECT one. Sockets carrying server.RoutingMark, i.e. the
+// proxy's own connections, are left alone so they don't loop back.
+func FirewallRules(format string, server config.ServerConfig) (string, error) {
+	mode, addr := TransparentTProxy, server.TProxyAddr
+	if addr == "" {
+		mode, addr = TransparentRedirect, server.RedirAddr
+	}
+	if addr == "" {
+		return "", fmt.Errorf("neither server.redir_addr nor server.tproxy_addr is set")
+	}
+	if server.RoutingMark == 0 {
+		return "", fmt.Errorf("server.routing_mark must be set so the proxy's own traffic can be excluded")
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s address %q: %w", mode, addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s address %q: %w", mode, addr, err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# splitdial transparent proxy rules (%s, %s to port %d).\n", format, mode, port)
+	fmt.Fprintf(&b, "# Sockets marked %#x (server.routing_mark) are the proxy's own and are skipped.\n", server.RoutingMark)
+	fmt.Fprintf(&b, "set -e\n\n")
+
+	if mode == TransparentTProxy {
+		fmt.Fprintf(&b, "# Deliver packets marked %#x to the local TPROXY listener\n", config.TProxyMark)
+		for _, ip := range []string{"ip", "ip -6"} {
+			fmt.Fprintf(&b, "%s rule add fwmark %#x lookup %d\n", ip, config.TProxyMark, tproxyTable)
+		}
+		fmt.Fprintf(&b, "ip route add local 0.0.0.0/0 dev lo table %d\n", tproxyTable)
+		fmt.Fprintf(&b, "ip -6 route add local ::/0 dev lo table %d\n\n", tproxyTable)
+	}
+
+	switch format {
+	case FirewallNftables:
+		writeNftablesRules(&b, mode, port, server.RoutingMark)
+	case FirewallIptables:
+		for _, cmd := range []string{"iptables", "ip6tables"} {
+			writeIptablesRules(&b, cmd, mode, port, server.RoutingMark)
+		}
+	default:
+		return "", fmt.Errorf("unknown firewall format %q (use %s or %s)", format, FirewallNftables, FirewallIptables)
+	}
+	return b.String(), nil
+}
+
+// writeNftablesRules writes an nft script in its own table, which can be
+// removed with "nft delete table inet splitdial".
+func writeNftablesRules(b *strings.Builder, mode string, port, mark int) {
+	bypass := func(indent string) {
+		fmt.Fprintf(b, "%sip daddr @bypass4 return\n", indent)
+		fmt.Fprintf(b, "%sip6 daddr @bypass6 return\n", indent)
+	}
+
+	fmt.Fprintf(b, "nft -f - <<'EOF'\n")
+	fmt.Fprintf(b, "table inet splitdial\n")
+	fmt.Fprintf(b, "delete table inet splitdial\n")
+	fmt.Fprintf(b, "table inet splitdial {\n")
+	fmt.Fprintf(b, "\tset bypass4 {\n\t\ttype ipv4_addr; flags interval\n\t\telements = { %s }\n\t}\n", strings.Join(bypassIPv4, ", "))
+	fmt.Fprintf(b, "\tset bypass6 {\n\t\ttype ipv6_addr; flags interval\n\t\telements = { %s }\n\t}\n\n", strings.Join(bypassIPv6, ", "))
+
+	if mode == TransparentTProxy {
+		fmt.Fprintf(b, "\t# Forwarded traffic, and local traffic rerouted through lo below\n")
+		fmt.Fprintf(b, "\tchain prerouting {\n\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+		fmt.Fprintf(b, "\t\tfib daddr type local return\n")
+		bypass("\t\t")
+		fmt.Fprintf(b, "\t\tmeta l4proto tcp tproxy to :%d meta mark set %#x accept\n\t}\n\n", port, config.TProxyMark)
+		fmt.Fprintf(b, "\t# Local traffic, except the proxy's own\n")
+		fmt.Fprintf(b, "\tchain output {\n\t\ttype route hook output priority mangle; policy accept;\n")
+		fmt.Fprintf(b, "\t\tmeta mark %#x return\n", mark)
+		bypass("\t\t")
+		fmt.Fprintf(b, "\t\tmeta l4proto tcp meta mark set %#x\n\t}\n", config.TProxyMark)
+	} else {
+		fmt.Fprintf(b, "\t# Forwarded traffic; the listener must accept on the LAN address\n")
+		fmt.Fprintf(b, "\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		bypass("\t\t")
+		fmt.Fprintf(b, "\t\tmeta l4proto tcp redirect to :%d\n\t}\n\n", port)
+		fmt.Fprintf(b, "\t# Local traffic, except the proxy's own\n")
+		fmt.Fprintf(b, "\tchain output {\n\t\ttype nat hook output priority -100; policy accept;\n")
+		fmt.Fprintf(b, "\t\tmeta mark %#x return\n", mark)
+		bypass("\t\t")
+		fmt.Fprintf(b, "\t\tmeta l4proto tcp redirect to :%d\n\t}\n", port)
+	}
+	fmt.Fprintf(b, "}\nEOF\n")
+}
+
+// writeIptablesRules writes the rules for one of iptables or ip6tables, in
+// SPLITDIAL chains so they can be flushed together.
+func writeIptablesRules(b *strings.Builder, cmd, mode string, port, mark int) {
+	bypass := strings.Join(bypassIPv4, ",")
+	if cmd == "ip6tables" {
+		bypass = strings.Join(bypassIPv6, ",")
+	}
+
+	table := "nat"
+	if mode == TransparentTProxy {
+		table = "mangle"
+	}
+	rule := func(format string, args ...any) {
+		fmt.Fprintf(b, "%s -t %s %s\n", cmd, table, fmt.Sprintf(format, args...))
+	}
+
+	fmt.Fprintf(b, "# %s\n", cmd)
+	rule("-N SPLITDIAL")
+	rule("-A SPLITDIAL -d %s -j RETURN", bypass)
+	if mode == TransparentTProxy {
+		rule("-A SPLITDIAL -p tcp -j TPROXY --on-port %d --tproxy-mark %#x", port, config.TProxyMark)
+		rule("-A PREROUTING -p tcp -m addrtype ! --dst-type LOCAL -j SPLITDIAL")
+		rule("-N SPLITDIAL_LOCAL")
+		rule("-A SPLITDIAL_LOCAL -m mark --mark %#x -j RETURN", mark)
+		rule("-A SPLITDIAL_LOCAL -d %s -j RETURN", bypass)
+		rule("-A SPLITDIAL_LOCAL -p tcp -j MARK --set-mark %#x", config.TProxyMark)
+		rule("-A OUTPUT -p tcp -j SPLITDIAL_LOCAL")
+	} else {
+		rule("-A SPLITDIAL -p tcp -j REDIRECT --to-ports %d", port)
+		rule("-A PREROUTING -p tcp -j SPLITDIAL")
+		rule("-N SPLITDIAL_LOCAL")
+		rule("-A SPLITDIAL_LOCAL -m mark --mark %#x -j RETURN", mark)
+		rule("-A SPLITDIAL_LOCAL -j SPLITDIAL")
+		rule("-A OUTPUT -p tcp -j SPLITDIAL_LOCAL")
+	}
+	fmt.Fprintf(b, "\n")
+}
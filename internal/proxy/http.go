@@ -1,8 +1,9 @@
 package proxy
 
 import (
-	"bufio"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,30 +13,53 @@ import (
 	"sync"
 	"time"
 
+	"github.com/waylen888/splitdial/internal/auth"
 	"github.com/waylen888/splitdial/internal/logging"
 	"github.com/waylen888/splitdial/internal/network"
 	"github.com/waylen888/splitdial/internal/router"
 )
 
-// HTTPProxyServer implements an HTTP CONNECT proxy server.
+// proxyAuthRealm is the realm of the Basic authentication challenge.
+const proxyAuthRealm = "splitdial"
+
+// maxChallengeDrain is how much of a rejected request's body is read, so
+// that the client can retry on the same connection.
+const maxChallengeDrain = 64 << 10
+
+// HTTPProxyServer implements an HTTP forward proxy with CONNECT support.
 type HTTPProxyServer struct {
-	addr     string
-	router   *router.Router
-	dialer   *network.InterfaceDialer
-	listener net.Listener
-	mu       sync.Mutex
-	running  bool
+	addr       string
+	router     *router.Router
+	dialer     *network.InterfaceDialer
+	users      *auth.Users
+	via        string                   // pseudonym for the Via header, empty to omit it
+	transports map[string]*upstreamPool // upstream connection pools, see transportKey
+	lastPrune  time.Time                // when unused pools were last closed
+	listener   net.Listener
+	mu         sync.Mutex
+	running    bool
 }
 
-// NewHTTPProxyServer creates a new HTTP proxy server.
-func NewHTTPProxyServer(addr string, router *router.Router, dialer *network.InterfaceDialer) *HTTPProxyServer {
+// NewHTTPProxyServer creates a new HTTP proxy server. When users are
+// configured, clients must send Proxy-Authorization with Basic credentials.
+func NewHTTPProxyServer(addr string, router *router.Router, dialer *network.InterfaceDialer, users *auth.Users) *HTTPProxyServer {
 	return &HTTPProxyServer{
-		addr:   addr,
-		router: router,
-		dialer: dialer,
+		addr:       addr,
+		router:     router,
+		dialer:     dialer,
+		users:      users,
+		transports: make(map[string]*upstreamPool),
 	}
 }
 
+// SetVia sets the pseudonym added to the Via header of forwarded requests
+// and responses, e.g. "splitdial". An empty pseudonym omits the header.
+func (h *HTTPProxyServer) SetVia(via string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.via = via
+}
+
 // Start starts the HTTP proxy server.
 func (h *HTTPProxyServer) Start(ctx context.Context) error {
 	listener, err := net.Listen("tcp", h.addr)
@@ -79,34 +103,62 @@ func (h *HTTPProxyServer) Stop() error {
 	defer h.mu.Unlock()
 
 	h.running = false
+	for key, pool := range h.transports {
+		pool.transport.CloseIdleConnections()
+		delete(h.transports, key)
+	}
 	if h.listener != nil {
 		return h.listener.Close()
 	}
 	return nil
 }
 
-// handleConnection handles a single HTTP proxy client connection.
+// handleConnection handles an HTTP proxy client connection. Requests are
+// served until the client closes the connection or sends CONNECT, after
+// which the connection becomes a tunnel.
 func (h *HTTPProxyServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	conn.SetDeadline(time.Now().Add(30 * time.Second))
 
-	reader := bufio.NewReader(conn)
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		logging.Debug("Failed to read request", "error", err)
-		return
-	}
+	client := newBufferedConn(conn)
+	for {
+		req, err := http.ReadRequest(client.reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logging.Debug("Failed to read request", "error", err)
+			}
+			return
+		}
+
+		user, ok := h.authenticate(conn, req)
+		if !ok {
+			if !h.challenge(client, req) {
+				return
+			}
+			// Wait for the retry with credentials
+			conn.SetDeadline(time.Now().Add(httpIdleTimeout))
+			continue
+		}
+
+		// Clear deadline for data transfer
+		conn.SetDeadline(time.Time{})
+
+		if req.Method == http.MethodConnect {
+			h.handleConnect(client, req, user)
+			return
+		}
+		if !h.handleHTTP(client, req, user) {
+			return
+		}
 
-	if req.Method == http.MethodConnect {
-		h.handleConnect(conn, req)
-	} else {
-		h.handleHTTP(conn, req, reader)
+		// Wait for the next request on the kept-alive connection
+		conn.SetDeadline(time.Now().Add(httpIdleTimeout))
 	}
 }
 
 // handleConnect handles HTTPS CONNECT requests.
-func (h *HTTPProxyServer) handleConnect(conn net.Conn, req *http.Request) {
+func (h *HTTPProxyServer) handleConnect(conn net.Conn, req *http.Request, user string) {
 	host, portStr, err := net.SplitHostPort(req.Host)
 	if err != nil {
 		host = req.Host
@@ -114,59 +166,104 @@ func (h *HTTPProxyServer) handleConnect(conn net.Conn, req *http.Request) {
 	}
 
 	port, _ := strconv.Atoi(portStr)
-	result := h.router.Route(host, port)
-	logging.Info("CONNECT request", "host", req.Host, "interface", result.Interface, "rule", result.RuleName)
+	routeReq := router.Request{Host: host, Port: port, User: user}
+	result := h.router.Route(routeReq)
+	sniffed := result.Sniff
+	var domain string
+	if sniffed {
+		// The tunnel must be established before the client sends anything
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		result, domain, conn = sniffRoute(h.router, conn, routeReq, result)
+	}
+	logging.Info("CONNECT request", "host", req.Host, "domain", domain, "user", user, "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
 
 	target := net.JoinHostPort(host, portStr)
-	remote, err := h.dialer.DialTCP(target, result.Interface)
+	remote, err := dialRoute(context.Background(), h.dialer, result, target)
 	if err != nil {
-		http.Error(responseWriter{conn}, "Bad Gateway", http.StatusBadGateway)
+		if !sniffed {
+			writeDialError(conn, err)
+		}
 		logging.Warn("Failed to connect", "target", target, "error", err)
 		return
 	}
 	defer remote.Close()
 
 	// Send 200 Connection Established
-	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-	conn.SetDeadline(time.Time{})
+	if !sniffed {
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}
 
 	// Relay data
 	h.relay(conn, remote)
 }
 
-// handleHTTP handles regular HTTP requests.
-func (h *HTTPProxyServer) handleHTTP(conn net.Conn, req *http.Request, reader *bufio.Reader) {
-	host := req.Host
-	portStr := "80"
+// authenticate checks the request's Proxy-Authorization header against the
+// configured users and returns the user name, which is empty when no users
+// are configured.
+func (h *HTTPProxyServer) authenticate(conn net.Conn, req *http.Request) (string, bool) {
+	if !h.users.Enabled() {
+		return "", true
+	}
 
-	if hostPort := strings.Split(host, ":"); len(hostPort) == 2 {
-		host = hostPort[0]
-		portStr = hostPort[1]
+	name, password, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		// Clients usually send credentials only after the first challenge
+		return "", false
+	}
+	if !h.users.Verify(name, password) {
+		logging.Warn("HTTP proxy authentication failed", "user", name, "client", conn.RemoteAddr().String())
+		return "", false
 	}
+	return name, true
+}
 
-	port, _ := strconv.Atoi(portStr)
-	result := h.router.Route(host, port)
-	logging.Info("HTTP request", "method", req.Method, "url", req.URL.String(), "interface", result.Interface, "rule", result.RuleName)
+// challenge answers a request lacking valid credentials with 407 Proxy
+// Authentication Required. It reports whether the client can retry on the
+// same connection.
+func (h *HTTPProxyServer) challenge(conn net.Conn, req *http.Request) bool {
+	keepAlive := req.ProtoAtLeast(1, 1) && !req.Close
+	if req.Body != nil {
+		n, err := io.Copy(io.Discard, io.LimitReader(req.Body, maxChallengeDrain+1))
+		if err != nil || n > maxChallengeDrain {
+			keepAlive = false
+		}
+	}
 
-	target := net.JoinHostPort(host, portStr)
-	remote, err := h.dialer.DialTCP(target, result.Interface)
+	resp := &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+		Close:      !keepAlive,
+	}
+	resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	return keepAlive
+}
+
+// parseBasicAuth parses "Basic base64(user:password)" credentials.
+func parseBasicAuth(header string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
 	if err != nil {
-		http.Error(responseWriter{conn}, "Bad Gateway", http.StatusBadGateway)
-		logging.Warn("Failed to connect", "target", target, "error", err)
-		return
+		return "", "", false
 	}
-	defer remote.Close()
+	return strings.Cut(string(decoded), ":")
+}
 
-	// Forward the request
-	if err := req.Write(remote); err != nil {
-		logging.Debug("Failed to write request", "error", err)
+// writeDialError writes the HTTP error response for a failed upstream dial.
+func writeDialError(conn net.Conn, err error) {
+	if errors.Is(err, errRejectedByPolicy) || errors.Is(err, network.ErrInterfaceUnavailable) {
+		http.Error(responseWriter{conn}, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
-
-	conn.SetDeadline(time.Time{})
-
-	// Relay response
-	io.Copy(conn, remote)
+	http.Error(responseWriter{conn}, "Bad Gateway", http.StatusBadGateway)
 }
 
 // relay relays data between two connections.
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+const (
+	// httpIdleTimeout closes a kept-alive client connection that sends no
+	// new request.
+	httpIdleTimeout = 90 * time.Second
+
+	// upstreamIdleTimeout closes pooled upstream connections left unused.
+	upstreamIdleTimeout = 90 * time.Second
+
+	// maxIdleUpstreamConns is the number of idle upstream connections kept
+	// per origin and route.
+	maxIdleUpstreamConns = 8
+)
+
+// hopHeaders apply to a single connection and are not forwarded (RFC 9110,
+// section 7.6.1). The Proxy-* headers are addressed to this proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// routeContextKey carries a request's router.RouteResult to the transport's
+// dial function.
+type routeContextKey struct{}
+
+// handleHTTP forwards a plain HTTP request in absolute form and writes the
+// response to the client. Each request is routed on its own, so requests
+// for different hosts on one client connection can use different
+// interfaces. It reports whether the client connection can be reused.
+func (h *HTTPProxyServer) handleHTTP(conn net.Conn, req *http.Request, user string) bool {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		http.Error(responseWriter{conn}, "Bad Request", http.StatusBadRequest)
+		logging.Debug("Rejecting non-proxy request", "method", req.Method, "uri", req.RequestURI)
+		return false
+	}
+
+	host, portStr := req.URL.Hostname(), req.URL.Port()
+	if portStr == "" {
+		portStr = "80"
+	}
+	port, _ := strconv.Atoi(portStr)
+	result := h.router.Route(router.Request{Host: host, Port: port, User: user})
+	logging.Info("HTTP request", "method", req.Method, "url", req.URL.String(), "user", user, "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+
+	h.mu.Lock()
+	via := h.via
+	h.mu.Unlock()
+
+	// Pooled upstream connections count as active for the balancer only
+	// while they serve a request
+	var upstreams []*trackedConn
+	defer func() {
+		for _, c := range upstreams {
+			c.idle()
+		}
+	}()
+	ctx := httptrace.WithClientTrace(context.WithValue(context.Background(), routeContextKey{}, result), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if c, ok := info.Conn.(*trackedConn); ok {
+				c.resume()
+				upstreams = append(upstreams, c)
+			}
+		},
+	})
+
+	// The transport writes the request in origin form
+	outreq := req.Clone(ctx)
+	outreq.RequestURI = ""
+	outreq.Close = false
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(outreq.Header)
+	if upgrade != "" {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", upgrade)
+	}
+	if _, ok := outreq.Header["User-Agent"]; !ok {
+		// Don't let the transport add its own
+		outreq.Header.Set("User-Agent", "")
+	}
+	if via != "" {
+		outreq.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, via))
+	}
+
+	resp, err := h.transport(result).RoundTrip(outreq)
+	if err != nil {
+		writeDialError(conn, err)
+		logging.Warn("Failed to forward request", "url", req.URL.String(), "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.handleUpgrade(conn, resp)
+		return false
+	}
+
+	removeHopHeaders(resp.Header)
+	if via != "" {
+		resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, via))
+	}
+	// The client connection speaks our version, not the origin's
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+
+	// Frame the body for the client rather than the origin: chunk bodies of
+	// unknown length for HTTP/1.1 clients, and close the connection after
+	// them for HTTP/1.0 clients, which don't understand chunking
+	keepAlive := !req.Close
+	resp.TransferEncoding = nil
+	if bodyAllowed(req, resp) && resp.ContentLength < 0 {
+		if req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		} else {
+			keepAlive = false
+		}
+	}
+	resp.Close = !keepAlive
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+
+	if err := resp.Write(conn); err != nil {
+		logging.Debug("Failed to write response", "url", req.URL.String(), "error", err)
+		return false
+	}
+	return keepAlive
+}
+
+// handleUpgrade completes a protocol switch (e.g., WebSocket) by sending the
+// 101 response to the client and relaying both ways until either side closes.
+func (h *HTTPProxyServer) handleUpgrade(conn net.Conn, resp *http.Response) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(responseWriter{conn}, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(conn)
+	conn.Write([]byte("\r\n"))
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// upstreamPool is the transport of a route key and when it was last used.
+type upstreamPool struct {
+	transport *http.Transport
+	lastUse   time.Time
+}
+
+// transport returns the upstream connection pool for a route. Pools whose
+// route has not been used for upstreamIdleTimeout, e.g. after a rule or
+// interface change, are closed and forgotten.
+func (h *HTTPProxyServer) transport(result router.RouteResult) *http.Transport {
+	key := transportKey(result)
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.lastPrune) >= upstreamIdleTimeout {
+		h.lastPrune = now
+		for k, pool := range h.transports {
+			if now.Sub(pool.lastUse) >= upstreamIdleTimeout {
+				pool.transport.CloseIdleConnections()
+				delete(h.transports, k)
+			}
+		}
+	}
+
+	pool, ok := h.transports[key]
+	if !ok {
+		pool = &upstreamPool{transport: &http.Transport{
+			DialContext:         h.dialUpstream,
+			MaxIdleConnsPerHost: maxIdleUpstreamConns,
+			IdleConnTimeout:     upstreamIdleTimeout,
+			DisableCompression:  true, // pass the client's Accept-Encoding through
+		}}
+		h.transports[key] = pool
+	}
+	pool.lastUse = now
+	return pool.transport
+}
+
+// dialUpstream dials an upstream connection for the route carried by ctx.
+// The connection starts out idle; handleHTTP counts it as active while it
+// serves a request.
+func (h *HTTPProxyServer) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	result, _ := ctx.Value(routeContextKey{}).(router.RouteResult)
+	conn, err := dialRoute(ctx, h.dialer, result, addr)
+	if c, ok := conn.(*trackedConn); ok {
+		c.idle()
+	}
+	return conn, err
+}
+
+// transportKey identifies routes whose upstream connections are
+// interchangeable: the same interface (or race candidates), health state and
+// on_interface_down policy.
+func transportKey(result router.RouteResult) string {
+	key := result.Interface
+	if len(result.Candidates) > 0 {
+		key = strings.Join(result.Candidates, ",")
+	}
+	if result.Unhealthy {
+		key += "!down"
+	}
+	return key + "|" + result.OnInterfaceDown
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including those named in the
+// Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// upgradeType returns the protocol a request asks to switch to, or "".
+func upgradeType(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// bodyAllowed reports whether a response to req may have a body.
+func bodyAllowed(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
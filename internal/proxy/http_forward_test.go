@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+func TestTransportPrunesUnusedPools(t *testing.T) {
+	h := NewHTTPProxyServer("", nil, nil, nil)
+
+	stale := h.transport(router.RouteResult{Interface: "wifi"})
+	h.transport(router.RouteResult{Interface: "cable"})
+	if len(h.transports) != 2 {
+		t.Fatalf("pools = %d, want 2", len(h.transports))
+	}
+
+	// Pretend wifi has not been routed to since long before the last prune
+	h.mu.Lock()
+	h.transports[transportKey(router.RouteResult{Interface: "wifi"})].lastUse = time.Now().Add(-2 * upstreamIdleTimeout)
+	h.lastPrune = time.Time{}
+	h.mu.Unlock()
+
+	if got := h.transport(router.RouteResult{Interface: "cable"}); got == stale {
+		t.Fatal("got the wifi pool for cable")
+	}
+	if len(h.transports) != 1 {
+		t.Fatalf("pools after prune = %d, want 1", len(h.transports))
+	}
+	if h.transport(router.RouteResult{Interface: "wifi"}) == stale {
+		t.Fatal("pruned pool was reused")
+	}
+}
+
+// TestPooledUpstreamNotActive checks that a kept-alive upstream connection
+// counts as active for the balancer only while it serves a request.
+func TestPooledUpstreamNotActive(t *testing.T) {
+	device, ip := uplinkDevice(t)
+	r := router.NewRouter([]config.RouteRule{{
+		ID:         "lb",
+		Match:      config.Match{IPs: []string{ip.String() + "/32"}},
+		Interfaces: []string{"up"},
+		Strategy:   config.StrategyLeastConnections,
+		Enabled:    true,
+	}}, "up")
+	im := network.NewInterfaceManager(map[string]network.Uplink{
+		"up": {Device: device, Bind: config.BindIP},
+	})
+	h := NewHTTPProxyServer("", r, network.NewInterfaceDialer(im, 5*time.Second), nil)
+
+	var during []int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		during = append(during, memberStats(t, r).Active)
+		io.WriteString(w, "ok")
+	}))
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Listener = ln
+	upstream.Start()
+	defer upstream.Close()
+
+	for i := range 3 {
+		forwardRequest(t, h, "GET "+upstream.URL+"/ HTTP/1.1\r\nHost: "+upstream.Listener.Addr().String()+"\r\n\r\n")
+		if got := memberStats(t, r); got.Active != 0 || got.Total != 1 {
+			t.Fatalf("after request %d: active %d, total %d; want 0, 1", i, got.Active, got.Total)
+		}
+	}
+	for i, active := range during {
+		if active != 1 {
+			t.Fatalf("during request %d: active %d, want 1", i, active)
+		}
+	}
+}
+
+// forwardRequest passes a raw proxy request to handleHTTP and reads the
+// response.
+func forwardRequest(t *testing.T, h *HTTPProxyServer, raw string) {
+	t.Helper()
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		h.handleHTTP(server, req, "")
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("response %s %q", resp.Status, body)
+	}
+	// Wait for handleHTTP to return
+	io.Copy(io.Discard, client)
+}
+
+func memberStats(t *testing.T, r *router.Router) router.MemberStats {
+	t.Helper()
+	stats := r.BalancerStats()
+	if len(stats) != 1 || len(stats[0].Members) != 1 {
+		t.Fatalf("balancer stats = %+v", stats)
+	}
+	return stats[0].Members[0]
+}
+
+// uplinkDevice returns an interface with an IPv4 address usable as an
+// uplink, and the address.
+func uplinkDevice(t *testing.T) (string, net.IP) {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return iface.Name, ipNet.IP
+			}
+		}
+	}
+	t.Skip("no interface with an IPv4 address")
+	return "", nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+// MixedServer accepts SOCKS4, SOCKS4a, SOCKS5 and HTTP proxy clients on one
+// port. It peeks at the first byte of each connection and hands it to the
+// SOCKS or HTTP server, which share the router and dialer.
+type MixedServer struct {
+	addr     string
+	socks    *SOCKS5Server
+	http     *HTTPProxyServer
+	listener net.Listener
+	mu       sync.Mutex
+	running  bool
+}
+
+// NewMixedServer creates a mixed-protocol server dispatching to socks and http.
+func NewMixedServer(addr string, socks *SOCKS5Server, http *HTTPProxyServer) *MixedServer {
+	return &MixedServer{
+		addr:  addr,
+		socks: socks,
+		http:  http,
+	}
+}
+
+// Start starts the mixed-protocol server.
+func (m *MixedServer) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", m.addr)
+	if err != nil {
+		return fmt.Errorf("failed to start mixed proxy: %w", err)
+	}
+
+	m.mu.Lock()
+	m.listener = listener
+	m.running = true
+	m.mu.Unlock()
+
+	logging.Info("Mixed proxy listening", "addr", m.addr)
+
+	go func() {
+		<-ctx.Done()
+		m.Stop()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			m.mu.Lock()
+			running := m.running
+			m.mu.Unlock()
+
+			if !running {
+				return nil
+			}
+			logging.Error("Failed to accept connection", "error", err)
+			continue
+		}
+
+		go m.handleConnection(conn)
+	}
+}
+
+// Stop stops the mixed-protocol server.
+func (m *MixedServer) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.running = false
+	if m.listener != nil {
+		return m.listener.Close()
+	}
+	return nil
+}
+
+// handleConnection detects the protocol from the first byte: SOCKS requests
+// start with their version (4 or 5), HTTP requests with a method name.
+func (m *MixedServer) handleConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	bc := newBufferedConn(conn)
+	first, err := bc.reader.Peek(1)
+	if err != nil {
+		logging.Debug("Failed to detect protocol", "error", err)
+		conn.Close()
+		return
+	}
+
+	switch first[0] {
+	case socks4Version, socks5Version:
+		m.socks.handleConnection(bc)
+	default:
+		m.http.handleConnection(bc)
+	}
+}
+
+// Addr returns the address the server is listening on.
+func (m *MixedServer) Addr() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listener != nil {
+		return m.listener.Addr().String()
+	}
+	return m.addr
+}
+
+// bufferedConn is a connection whose reads go through a bufio.Reader, so
+// bytes peeked while detecting the protocol are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// newBufferedConn wraps conn with a buffered reader.
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Read reads from the buffer, then the connection.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/router"
+	"github.com/waylen888/splitdial/internal/sniff"
+)
+
+const (
+	// maxSniffBytes bounds how much of a stream is buffered while looking
+	// for its server name; large enough for a ClientHello split across
+	// records.
+	maxSniffBytes = 32 << 10
+
+	// maxQUICSniffDatagrams bounds how many datagrams to a new destination
+	// are held while waiting for the rest of a QUIC ClientHello.
+	maxQUICSniffDatagrams = 4
+)
+
+// sniffRoute reads the server name from the client's first bytes on a
+// connection whose route has Sniff set, and routes req again with it. It
+// returns the result to use, the sniffed name ("" if none was found) and the
+// connection to relay from, which replays the bytes read.
+func sniffRoute(r *router.Router, conn net.Conn, req router.Request, result router.RouteResult) (router.RouteResult, string, net.Conn) {
+	name, conn := sniffStream(conn, r.SniffTimeout())
+	if name == "" {
+		return result, "", conn
+	}
+	req.Domain = name
+	return r.Route(req), name, conn
+}
+
+// sniffStream waits up to timeout for the client's first bytes and returns
+// the server name they carry, if any. The returned connection replays the
+// bytes read.
+func sniffStream(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	bc := &bufferedConn{Conn: conn, reader: bufio.NewReaderSize(conn, maxSniffBytes)}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for want := 1; ; {
+		// Wait for more data, then look at everything that has arrived
+		if _, err := bc.reader.Peek(want); err != nil {
+			logging.Debug("Nothing to sniff", "client", conn.RemoteAddr().String(), "error", err)
+			return "", bc
+		}
+		data, _ := bc.reader.Peek(bc.reader.Buffered())
+
+		name, err := sniff.Stream(data)
+		if err == nil {
+			return name, bc
+		}
+		if !errors.Is(err, sniff.ErrIncomplete) {
+			return "", bc
+		}
+		want = len(data) + 1
+	}
+}
+
+// sniffQUIC looks for the server name in the QUIC Initial packets among the
+// first datagrams of a new UDP flow. It reports done false while the
+// ClientHello is incomplete and more datagrams may complete it; once done,
+// it returns the name, or "" if there is none.
+func sniffQUIC(datagrams [][]byte) (name string, done bool) {
+	name, err := sniff.QUIC(datagrams...)
+	if errors.Is(err, sniff.ErrIncomplete) && len(datagrams) < maxQUICSniffDatagrams {
+		return "", false
+	}
+	return name, true
+}
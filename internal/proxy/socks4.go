@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+const (
+	socks4Version = 0x04
+
+	// SOCKS4 reply codes; replies carry version 0
+	socks4ReplyVersion = 0x00
+	socks4Granted      = 0x5A
+	socks4Rejected     = 0x5B
+
+	// maxSOCKS4Field bounds the NUL-terminated USERID and domain fields.
+	maxSOCKS4Field = 255
+)
+
+// handleSOCKS4 serves a SOCKS4 or SOCKS4a CONNECT request, after the version
+// byte. SOCKS4 has no passwords, so it is refused when users are configured.
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	   1    1      2              4           variable       1
+//
+// SOCKS4a sets DSTIP to 0.0.0.x (x != 0) and appends the NUL-terminated
+// domain name after USERID.
+func (s *SOCKS5Server) handleSOCKS4(conn net.Conn) {
+	host, port, err := s.readSOCKS4Request(conn)
+	if err != nil {
+		s.sendSOCKS4Reply(conn, socks4Rejected, nil, 0)
+		logging.Debug("SOCKS4 request failed", "error", err)
+		return
+	}
+	if s.users.Enabled() {
+		s.sendSOCKS4Reply(conn, socks4Rejected, nil, 0)
+		logging.Warn("Rejecting SOCKS4 client, authentication is required", "client", conn.RemoteAddr().String(), "target", host)
+		return
+	}
+
+	// Clear deadline for data transfer
+	conn.SetDeadline(time.Time{})
+
+	req := router.Request{Host: host, Port: port}
+	result := s.router.Route(req)
+	sniffed := result.Sniff
+	var domain string
+	if sniffed {
+		// As for SOCKS5, the reply must come before the client's first bytes
+		s.sendSOCKS4Reply(conn, socks4Granted, nil, 0)
+		result, domain, conn = sniffRoute(s.router, conn, req, result)
+	}
+	logging.Info("Routing connection", "target", host, "port", port, "domain", domain, "protocol", "socks4", "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	remote, err := dialRoute(context.Background(), s.dialer, result, target)
+	if err != nil {
+		if !sniffed {
+			s.sendSOCKS4Reply(conn, socks4Rejected, nil, 0)
+		}
+		logging.Warn("Failed to connect", "target", target, "error", err)
+		return
+	}
+	defer remote.Close()
+
+	if !sniffed {
+		local := remote.LocalAddr().(*net.TCPAddr)
+		s.sendSOCKS4Reply(conn, socks4Granted, local.IP, local.Port)
+	}
+
+	relay(conn, remote)
+}
+
+// readSOCKS4Request reads a SOCKS4/4a request and returns its destination.
+func (s *SOCKS5Server) readSOCKS4Request(conn net.Conn) (string, int, error) {
+	header := make([]byte, 7) // CD, DSTPORT, DSTIP
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, fmt.Errorf("failed to read request: %w", err)
+	}
+	if _, err := readNulTerminated(conn); err != nil { // USERID
+		return "", 0, fmt.Errorf("failed to read user ID: %w", err)
+	}
+
+	if header[0] != cmdConnect {
+		return "", 0, fmt.Errorf("unsupported SOCKS4 command: %d", header[0])
+	}
+
+	port := int(binary.BigEndian.Uint16(header[1:3]))
+	ip := net.IP(header[3:7])
+
+	// SOCKS4a: 0.0.0.x means the domain name follows
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNulTerminated(conn)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read domain: %w", err)
+		}
+		if domain == "" {
+			return "", 0, errors.New("empty SOCKS4a domain")
+		}
+		return domain, port, nil
+	}
+
+	return ip.String(), port, nil
+}
+
+// readNulTerminated reads a NUL-terminated field of at most maxSOCKS4Field
+// bytes.
+func readNulTerminated(r io.Reader) (string, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(field), nil
+		}
+		if len(field) == maxSOCKS4Field {
+			return "", errors.New("field too long")
+		}
+		field = append(field, b[0])
+	}
+}
+
+// sendSOCKS4Reply sends a SOCKS4 reply.
+func (s *SOCKS5Server) sendSOCKS4Reply(conn net.Conn, status byte, ip net.IP, port int) {
+	reply := make([]byte, 8)
+	reply[0] = socks4ReplyVersion
+	reply[1] = status
+	binary.BigEndian.PutUint16(reply[2:4], uint16(port))
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(reply[4:], ip4)
+	}
+
+	conn.Write(reply)
+}
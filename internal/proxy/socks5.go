@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/waylen888/splitdial/internal/auth"
 	"github.com/waylen888/splitdial/internal/logging"
 	"github.com/waylen888/splitdial/internal/network"
 	"github.com/waylen888/splitdial/internal/router"
@@ -24,6 +26,11 @@ const (
 	authPassword = 0x02
 	authNoAccept = 0xFF
 
+	// Username/password authentication (RFC 1929)
+	authPasswordVersion = 0x01
+	authStatusSuccess   = 0x00
+	authStatusFailure   = 0x01
+
 	// Commands
 	cmdConnect      = 0x01
 	cmdBind         = 0x02
@@ -51,18 +58,21 @@ type SOCKS5Server struct {
 	addr           string
 	router         *router.Router
 	dialer         *network.InterfaceDialer
+	users          *auth.Users
 	listener       net.Listener
 	mu             sync.Mutex
 	running        bool
 	connectionPool sync.Pool
 }
 
-// NewSOCKS5Server creates a new SOCKS5 proxy server.
-func NewSOCKS5Server(addr string, router *router.Router, dialer *network.InterfaceDialer) *SOCKS5Server {
+// NewSOCKS5Server creates a new SOCKS5 proxy server. If users has any
+// users configured, clients must authenticate with username/password.
+func NewSOCKS5Server(addr string, router *router.Router, dialer *network.InterfaceDialer, users *auth.Users) *SOCKS5Server {
 	return &SOCKS5Server{
 		addr:   addr,
 		router: router,
 		dialer: dialer,
+		users:  users,
 	}
 }
 
@@ -122,14 +132,31 @@ func (s *SOCKS5Server) handleConnection(conn net.Conn) {
 	// Set read deadline for handshake
 	conn.SetDeadline(time.Now().Add(30 * time.Second))
 
+	// The version byte tells SOCKS4/4a and SOCKS5 clients apart
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		logging.Debug("Failed to read SOCKS version", "error", err)
+		return
+	}
+	switch version[0] {
+	case socks4Version:
+		s.handleSOCKS4(conn)
+		return
+	case socks5Version:
+	default:
+		logging.Debug("Unsupported SOCKS version", "version", version[0])
+		return
+	}
+
 	// Step 1: Version and methods negotiation
-	if err := s.handleHandshake(conn); err != nil {
+	user, err := s.handleHandshake(conn)
+	if err != nil {
 		logging.Debug("Handshake failed", "error", err)
 		return
 	}
 
 	// Step 2: Handle client request
-	targetAddr, port, err := s.handleRequest(conn)
+	cmd, targetAddr, port, err := s.handleRequest(conn)
 	if err != nil {
 		logging.Debug("Request handling failed", "error", err)
 		return
@@ -138,79 +165,149 @@ func (s *SOCKS5Server) handleConnection(conn net.Conn) {
 	// Clear deadline for data transfer
 	conn.SetDeadline(time.Time{})
 
+	switch cmd {
+	case cmdUDPAssociate:
+		s.handleUDPAssociate(conn, user, targetAddr, port)
+		return
+	case cmdBind:
+		s.handleBind(conn, user, targetAddr, port)
+		return
+	}
+
 	// Step 3: Route and connect
-	result := s.router.Route(targetAddr, port)
-	logging.Info("Routing connection", "target", targetAddr, "port", port, "interface", result.Interface, "rule", result.RuleName)
+	req := router.Request{Host: targetAddr, Port: port, User: user}
+	result := s.router.Route(req)
+	sniffed := result.Sniff
+	var domain string
+	if sniffed {
+		// The client sends nothing before the reply, so reply first; a
+		// failed dial can then only close the connection
+		s.sendReply(conn, repSuccess, "0.0.0.0", 0)
+		result, domain, conn = sniffRoute(s.router, conn, req, result)
+	}
+	logging.Info("Routing connection", "target", targetAddr, "port", port, "domain", domain, "user", user, "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
 
 	target := net.JoinHostPort(targetAddr, strconv.Itoa(port))
-	remote, err := s.dialer.DialTCP(target, result.Interface)
+	remote, err := dialRoute(context.Background(), s.dialer, result, target)
 	if err != nil {
-		s.sendReply(conn, repHostUnreachable, "0.0.0.0", 0)
+		if !sniffed {
+			s.sendReply(conn, dialErrorReply(err), "0.0.0.0", 0)
+		}
 		logging.Warn("Failed to connect", "target", target, "error", err)
 		return
 	}
 	defer remote.Close()
 
 	// Send success reply
-	localAddr := remote.LocalAddr().(*net.TCPAddr)
-	s.sendReply(conn, repSuccess, localAddr.IP.String(), localAddr.Port)
+	if !sniffed {
+		localAddr := remote.LocalAddr().(*net.TCPAddr)
+		s.sendReply(conn, repSuccess, localAddr.IP.String(), localAddr.Port)
+	}
 
 	// Step 4: Relay data
-	s.relay(conn, remote)
+	relay(conn, remote)
 }
 
-// handleHandshake handles SOCKS5 authentication handshake.
-func (s *SOCKS5Server) handleHandshake(conn net.Conn) error {
-	// Read version and number of methods
-	header := make([]byte, 2)
-	if _, err := io.ReadFull(conn, header); err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+// dialErrorReply maps a dial error to a SOCKS5 reply code.
+func dialErrorReply(err error) byte {
+	switch {
+	case errors.Is(err, errRejectedByPolicy):
+		return repConnectionNotAllowed
+	case errors.Is(err, network.ErrInterfaceUnavailable):
+		return repNetworkUnreachable
+	default:
+		return repHostUnreachable
 	}
+}
 
-	if header[0] != socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+// handleHandshake handles SOCKS5 authentication handshake, after the version
+// byte. If users are configured, the client must authenticate with
+// username/password, and the user name is returned.
+func (s *SOCKS5Server) handleHandshake(conn net.Conn) (string, error) {
+	// Read number of methods
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("failed to read header: %w", err)
 	}
 
-	numMethods := int(header[1])
+	numMethods := int(header[0])
 	methods := make([]byte, numMethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return fmt.Errorf("failed to read methods: %w", err)
+		return "", fmt.Errorf("failed to read methods: %w", err)
 	}
 
-	// Check for no-auth method
-	hasNoAuth := false
-	for _, m := range methods {
-		if m == authNone {
-			hasNoAuth = true
-			break
-		}
+	method := byte(authNone)
+	if s.users.Enabled() {
+		method = authPassword
 	}
 
-	if !hasNoAuth {
+	if !bytes.Contains(methods, []byte{method}) {
 		conn.Write([]byte{socks5Version, authNoAccept})
-		return errors.New("no acceptable auth method")
+		return "", errors.New("no acceptable auth method")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == authPassword {
+		return s.authenticate(conn)
+	}
+	return "", nil
+}
+
+// authenticate performs username/password authentication (RFC 1929) and
+// returns the user name.
+func (s *SOCKS5Server) authenticate(conn net.Conn) (string, error) {
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("failed to read auth request: %w", err)
+	}
+	if header[0] != authPasswordVersion {
+		return "", fmt.Errorf("unsupported auth version: %d", header[0])
+	}
+	name := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return "", fmt.Errorf("failed to read username: %w", err)
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+
+	if !s.users.Verify(string(name), string(password)) {
+		conn.Write([]byte{authPasswordVersion, authStatusFailure})
+		logging.Warn("SOCKS5 authentication failed", "user", string(name), "client", conn.RemoteAddr().String())
+		return "", fmt.Errorf("authentication failed for user %q", name)
 	}
 
-	// Accept no-auth
-	_, err := conn.Write([]byte{socks5Version, authNone})
-	return err
+	_, err := conn.Write([]byte{authPasswordVersion, authStatusSuccess})
+	return string(name), err
 }
 
-// handleRequest handles SOCKS5 connection request.
-func (s *SOCKS5Server) handleRequest(conn net.Conn) (string, int, error) {
+// handleRequest handles SOCKS5 connection request, returning the command
+// and its destination address.
+func (s *SOCKS5Server) handleRequest(conn net.Conn) (byte, string, int, error) {
 	// Read request header
 	header := make([]byte, 4)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", 0, fmt.Errorf("failed to read request: %w", err)
+		return 0, "", 0, fmt.Errorf("failed to read request: %w", err)
 	}
 
 	if header[0] != socks5Version {
-		return "", 0, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		return 0, "", 0, fmt.Errorf("unsupported SOCKS version: %d", header[0])
 	}
 
-	if header[1] != cmdConnect {
+	cmd := header[1]
+	if cmd != cmdConnect && cmd != cmdBind && cmd != cmdUDPAssociate {
 		s.sendReply(conn, repCommandNotSupported, "0.0.0.0", 0)
-		return "", 0, fmt.Errorf("unsupported command: %d", header[1])
+		return 0, "", 0, fmt.Errorf("unsupported command: %d", cmd)
 	}
 
 	// Read address
@@ -219,41 +316,41 @@ func (s *SOCKS5Server) handleRequest(conn net.Conn) (string, int, error) {
 	case addrTypeIPv4:
 		ip := make([]byte, 4)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", 0, err
+			return 0, "", 0, err
 		}
 		addr = net.IP(ip).String()
 
 	case addrTypeDomain:
 		lenBuf := make([]byte, 1)
 		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			return "", 0, err
+			return 0, "", 0, err
 		}
 		domain := make([]byte, lenBuf[0])
 		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", 0, err
+			return 0, "", 0, err
 		}
 		addr = string(domain)
 
 	case addrTypeIPv6:
 		ip := make([]byte, 16)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", 0, err
+			return 0, "", 0, err
 		}
 		addr = net.IP(ip).String()
 
 	default:
 		s.sendReply(conn, repAddressNotSupported, "0.0.0.0", 0)
-		return "", 0, fmt.Errorf("unsupported address type: %d", header[3])
+		return 0, "", 0, fmt.Errorf("unsupported address type: %d", header[3])
 	}
 
 	// Read port
 	portBuf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, portBuf); err != nil {
-		return "", 0, err
+		return 0, "", 0, err
 	}
 	port := int(binary.BigEndian.Uint16(portBuf))
 
-	return addr, port, nil
+	return cmd, addr, port, nil
 }
 
 // sendReply sends a SOCKS5 reply.
@@ -285,7 +382,7 @@ func (s *SOCKS5Server) sendReply(conn net.Conn, rep byte, addr string, port int)
 }
 
 // relay relays data between client and remote.
-func (s *SOCKS5Server) relay(client, remote net.Conn) {
+func relay(client, remote net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -293,8 +390,8 @@ func (s *SOCKS5Server) relay(client, remote net.Conn) {
 		defer wg.Done()
 		io.Copy(dst, src)
 		// Close write side to signal EOF
-		if tcpConn, ok := dst.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
 		}
 	}
 
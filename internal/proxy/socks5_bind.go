@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+// bindAcceptTimeout is how long a BIND request waits for the peer to connect.
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleBind serves a BIND request (RFC 1928, section 4) for user. host and
+// port name the peer expected to connect, and select the interface the
+// listening socket is opened on. The first reply carries the listening
+// address; the second is sent once the peer connects, and carries the
+// peer's address.
+func (s *SOCKS5Server) handleBind(conn net.Conn, user, host string, port int) {
+	result := s.router.Route(router.Request{Host: host, Port: port, User: user})
+	logging.Info("Binding for peer", "peer", host, "port", port, "user", user, "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	ln, err := listenRoute(context.Background(), s.dialer, result, target)
+	if err != nil {
+		s.sendReply(conn, dialErrorReply(err), "0.0.0.0", 0)
+		logging.Warn("Failed to bind", "peer", target, "error", err)
+		return
+	}
+	defer ln.Close()
+
+	// First reply: where the peer should connect
+	local := ln.Addr().(*net.TCPAddr)
+	s.sendReply(conn, repSuccess, local.IP.String(), local.Port)
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(bindAcceptTimeout))
+	peer, err := ln.Accept()
+	if err != nil {
+		s.sendReply(conn, repTTLExpired, "0.0.0.0", 0)
+		logging.Warn("No incoming connection for bind", "peer", target, "listen", local.String(), "error", err)
+		return
+	}
+	ln.Close()
+	defer peer.Close()
+
+	// Only the expected peer may connect. Its port is usually ephemeral, so
+	// only the IP is checked, and only if the request named one.
+	remote := peer.RemoteAddr().(*net.TCPAddr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.Equal(remote.IP) {
+		s.sendReply(conn, repConnectionNotAllowed, "0.0.0.0", 0)
+		logging.Warn("Unexpected peer for bind", "peer", target, "remote", remote.String())
+		return
+	}
+
+	// Second reply: who connected
+	s.sendReply(conn, repSuccess, remote.IP.String(), remote.Port)
+	logging.Info("Bind peer connected", "peer", remote.String(), "listen", local.String())
+
+	relay(conn, peer)
+}
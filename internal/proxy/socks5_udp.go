@@ -0,0 +1,568 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+const (
+	// udpIdleTimeout closes a UDP association after this long without
+	// datagrams in either direction.
+	udpIdleTimeout = 2 * time.Minute
+
+	// udpFlowIdleTimeout forgets a destination, and releases its route,
+	// after this long without datagrams from the client to it.
+	udpFlowIdleTimeout = time.Minute
+
+	// udpResolveTimeout bounds resolving a datagram's destination.
+	udpResolveTimeout = 10 * time.Second
+
+	// maxPendingUDPDatagrams bounds the datagrams queued for a destination
+	// while its route is set up; later ones are dropped.
+	maxPendingUDPDatagrams = 16
+
+	// maxUDPPacketSize is the largest datagram that can be relayed.
+	maxUDPPacketSize = 65535
+)
+
+// errUDPFragmented is returned for datagrams with a non-zero FRAG field;
+// fragment reassembly is not supported, so they are dropped.
+var errUDPFragmented = errors.New("fragmented UDP datagrams are not supported")
+
+// udpAssociation relays datagrams for one UDP ASSOCIATE request. Each
+// destination is routed the first time the client sends to it and keeps
+// that route until it is idle for udpFlowIdleTimeout, so a flow never
+// switches interfaces mid-stream. New destinations are set up in the
+// background, so a slow lookup does not hold up the others. Outbound
+// sockets are shared per interface and IP family.
+type udpAssociation struct {
+	server   *SOCKS5Server
+	user     string       // authenticated user, for routing
+	relay    *net.UDPConn // socket the client sends datagrams to
+	clientIP net.IP       // address of the control connection's client
+
+	mu      sync.Mutex
+	client  *net.UDPAddr              // learned from the first datagram unless given in the request
+	flows   map[string]*udpFlow       // destination host:port -> flow
+	sockets map[string]net.PacketConn // "uplink/family" -> outbound socket; "" uplink is the default route
+
+	lastActive atomic.Int64 // unix nanoseconds of the last datagram
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+// udpFlow is a destination of an association. Its fields are guarded by
+// udpAssociation.mu.
+type udpFlow struct {
+	ready   bool           // set up; until then datagrams are queued
+	queue   [][]byte       // datagrams waiting for the flow to be set up
+	more    chan struct{}  // signalled when a datagram is queued
+	conn    net.PacketConn // outbound socket, nil if the destination was rejected
+	addr    *net.UDPAddr   // resolved destination
+	release func()         // load-balancing release of the route
+	lastUse time.Time      // last datagram from the client
+}
+
+// handleUDPAssociate serves a UDP ASSOCIATE request. It opens a relay socket
+// on the address the client connected to and relays datagrams until the
+// control connection closes or the association is idle for udpIdleTimeout.
+func (s *SOCKS5Server) handleUDPAssociate(conn net.Conn, user, host string, port int) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		s.sendReply(conn, repGeneralFailure, "0.0.0.0", 0)
+		logging.Warn("Failed to open UDP relay", "error", err)
+		return
+	}
+
+	a := &udpAssociation{
+		server:   s,
+		user:     user,
+		relay:    relay,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		flows:    make(map[string]*udpFlow),
+		sockets:  make(map[string]net.PacketConn),
+		done:     make(chan struct{}),
+	}
+	// The client may give the address it will send from; zeros mean it
+	// does not know yet (RFC 1928, section 6)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && port != 0 {
+		a.client = &net.UDPAddr{IP: ip, Port: port}
+	}
+	a.touch()
+
+	s.sendReply(conn, repSuccess, local.IP.String(), relay.LocalAddr().(*net.UDPAddr).Port)
+	logging.Info("UDP association", "client", conn.RemoteAddr().String(), "user", user, "relay", relay.LocalAddr().String())
+
+	// The association ends when the control connection closes
+	go func() {
+		io.Copy(io.Discard, conn)
+		a.close()
+	}()
+	go a.expireIdle()
+
+	a.serve()
+	logging.Debug("UDP association closed", "client", conn.RemoteAddr().String())
+}
+
+// serve relays datagrams from the client until the association closes.
+func (a *udpAssociation) serve() {
+	defer a.close()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.fromClient(from) {
+			logging.Debug("Dropping UDP datagram from unexpected source", "from", from.String())
+			continue
+		}
+
+		host, port, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			logging.Debug("Dropping UDP datagram", "from", from.String(), "error", err)
+			continue
+		}
+		a.touch()
+		a.send(host, port, payload)
+	}
+}
+
+// fromClient reports whether a datagram from addr belongs to the client,
+// learning the client's UDP address from its first datagram.
+func (a *udpAssociation) fromClient(addr *net.UDPAddr) bool {
+	if !addr.IP.Equal(a.clientIP) {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = addr
+		return true
+	}
+	return a.client.IP.Equal(addr.IP) && a.client.Port == addr.Port
+}
+
+// send relays a datagram to a destination. The first datagram to a new
+// destination starts setting up its flow; until that is done, datagrams are
+// queued and sent once it is.
+func (a *udpAssociation) send(host string, port int, payload []byte) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, ok := a.flows[target]
+	if !ok {
+		f = &udpFlow{more: make(chan struct{}, 1)}
+		a.flows[target] = f
+		go a.setup(f, target, host, port)
+	}
+	f.lastUse = time.Now()
+
+	if !f.ready {
+		if len(f.queue) >= maxPendingUDPDatagrams {
+			logging.Debug("Dropping UDP datagram while routing", "target", target)
+			return
+		}
+		f.queue = append(f.queue, append([]byte(nil), payload...))
+		select {
+		case f.more <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if f.conn != nil {
+		f.write(payload)
+	}
+}
+
+// write sends a datagram on a ready flow.
+func (f *udpFlow) write(datagram []byte) {
+	if _, err := f.conn.WriteTo(datagram, f.addr); err != nil {
+		logging.Debug("Failed to send UDP datagram", "target", f.addr.String(), "error", err)
+	}
+}
+
+// setup routes a new destination, sniffing its QUIC ClientHello if the
+// route asks for it, opens its flow and sends the queued datagrams. If the
+// destination cannot be reached its flow is removed, so the next datagram
+// retries; destinations rejected by policy keep a flow that drops datagrams.
+func (a *udpAssociation) setup(f *udpFlow, target, host string, port int) {
+	req := router.Request{Host: host, Port: port, User: a.user}
+	result := a.server.router.Route(req)
+	if result.Sniff {
+		if name := a.sniffFlow(f); name != "" {
+			req.Domain = name
+			result = a.server.router.Route(req)
+		}
+	}
+
+	conn, addr, release, err := a.route(req, result, target)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.done:
+		// Closed meanwhile; its flows were already released
+		if release != nil {
+			release()
+		}
+		return
+	default:
+	}
+	if err != nil {
+		logging.Debug("Failed to relay UDP", "target", target, "error", err)
+		if !errors.Is(err, errRejectedByPolicy) {
+			if a.flows[target] == f {
+				delete(a.flows, target)
+			}
+			return
+		}
+	}
+	f.ready, f.conn, f.addr, f.release = true, conn, addr, release
+	if conn != nil {
+		for _, datagram := range f.queue {
+			f.write(datagram)
+		}
+	}
+	f.queue = nil
+}
+
+// sniffFlow waits for the QUIC ClientHello among the datagrams queued for a
+// new flow and returns its server name, or "" if there is none or it is not
+// complete within the sniffing timeout.
+func (a *udpAssociation) sniffFlow(f *udpFlow) string {
+	timer := time.NewTimer(a.server.router.SniffTimeout())
+	defer timer.Stop()
+
+	for {
+		a.mu.Lock()
+		queue := f.queue
+		a.mu.Unlock()
+		if len(queue) > 0 {
+			if name, done := sniffQUIC(queue); done {
+				return name
+			}
+		}
+
+		select {
+		case <-f.more:
+		case <-timer.C:
+			return ""
+		case <-a.done:
+			return ""
+		}
+	}
+}
+
+// route opens the outbound socket for a new destination routed to result,
+// applying the rule's on_interface_down policy if the routed interface is
+// down. It returns the socket, the resolved destination and the function
+// releasing the route.
+func (a *udpAssociation) route(req router.Request, result router.RouteResult, target string) (net.PacketConn, *net.UDPAddr, func(), error) {
+	host, port := req.Host, req.Port
+	logging.Info("Routing UDP", "target", host, "port", port, "domain", req.Domain, "user", a.user, "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+	hosts := []string{host}
+	if len(result.Addrs) > 0 {
+		// Already resolved by the router
+		hosts = resolvedHosts(result.Addrs)
+	}
+
+	var reason error
+	if result.Unhealthy {
+		reason = fmt.Errorf("interface %s is unhealthy", result.Interface)
+	} else {
+		conn, addr, err := a.openFirst(result.Interface, hosts, port)
+		if err == nil {
+			return conn, addr, result.Acquire(), nil
+		}
+		result.Failed()
+		if !errors.Is(err, network.ErrInterfaceUnavailable) {
+			return nil, nil, nil, err
+		}
+		reason = err
+	}
+
+	uplink, err := interfaceDownRoute(result, target, reason)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn, addr, err := a.open(uplink, host, port)
+	return conn, addr, func() {}, err
+}
+
+// openFirst returns the uplink's socket for the first of hosts it can send
+// to. The error wraps ErrInterfaceUnavailable only if every host failed
+// for that reason.
+func (a *udpAssociation) openFirst(uplink string, hosts []string, port int) (net.PacketConn, *net.UDPAddr, error) {
+	var err error
+	for _, host := range hosts {
+		var conn net.PacketConn
+		var addr *net.UDPAddr
+		conn, addr, err = a.open(uplink, host, port)
+		if err == nil {
+			return conn, addr, nil
+		}
+		if !errors.Is(err, network.ErrInterfaceUnavailable) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+// open resolves a destination and returns the uplink's socket for the
+// destination's IP family. An empty uplink uses the system default route.
+func (a *udpAssociation) open(uplink, host string, port int) (net.PacketConn, *net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), udpResolveTimeout)
+	defer cancel()
+
+	dialer := a.server.dialer
+	ip := net.ParseIP(host)
+	if ip == nil {
+		var addrs []net.IPAddr
+		var err error
+		if uplink == "" {
+			addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+		} else {
+			addrs, err = dialer.LookupIPAddr(ctx, uplink, host)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ip = preferIPv4(addrs)
+	}
+	addr := &net.UDPAddr{IP: ip, Port: port}
+
+	family := "4"
+	if ip.To4() == nil {
+		family = "6"
+	}
+	key := uplink + "/" + family
+
+	a.mu.Lock()
+	conn, ok := a.sockets[key]
+	a.mu.Unlock()
+	if !ok {
+		var err error
+		if uplink == "" {
+			conn, err = dialer.ListenPacketDefault(ctx)
+		} else {
+			conn, err = dialer.ListenPacket(ctx, uplink, addr.String())
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		a.mu.Lock()
+		select {
+		case <-a.done:
+			a.mu.Unlock()
+			conn.Close()
+			return nil, nil, net.ErrClosed
+		default:
+		}
+		if existing, ok := a.sockets[key]; ok {
+			// Opened meanwhile for another destination
+			conn.Close()
+			conn = existing
+		} else {
+			a.sockets[key] = conn
+			go a.relayReplies(conn)
+		}
+		a.mu.Unlock()
+	}
+
+	return conn, addr, nil
+}
+
+// relayReplies sends datagrams received on an outbound socket back to the
+// client, prefixed with the sender's address.
+func (a *udpAssociation) relayReplies(conn net.PacketConn) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		src, ok := from.(*net.UDPAddr)
+		if client == nil || !ok {
+			continue
+		}
+		a.touch()
+
+		packet := appendUDPHeader(make([]byte, 0, n+22), src)
+		packet = append(packet, buf[:n]...)
+		if _, err := a.relay.WriteToUDP(packet, client); err != nil {
+			logging.Debug("Failed to send UDP datagram to client", "client", client.String(), "error", err)
+		}
+	}
+}
+
+// touch records activity on the association.
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// expireIdle closes the association once it has been idle for
+// udpIdleTimeout, and forgets destinations idle for udpFlowIdleTimeout.
+func (a *udpAssociation) expireIdle() {
+	ticker := time.NewTicker(udpFlowIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, a.lastActive.Load())) >= udpIdleTimeout {
+				logging.Debug("UDP association idle", "relay", a.relay.LocalAddr().String())
+				a.close()
+				return
+			}
+			a.expireFlows()
+		}
+	}
+}
+
+// expireFlows forgets the ready flows idle for udpFlowIdleTimeout and
+// releases their routes. A later datagram routes the destination again.
+func (a *udpAssociation) expireFlows() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for target, f := range a.flows {
+		if f.ready && time.Since(f.lastUse) >= udpFlowIdleTimeout {
+			if f.release != nil {
+				f.release()
+			}
+			delete(a.flows, target)
+		}
+	}
+}
+
+// close closes the relay and outbound sockets and releases routed flows.
+func (a *udpAssociation) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.relay.Close()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, conn := range a.sockets {
+			conn.Close()
+		}
+		for _, f := range a.flows {
+			if f.release != nil {
+				f.release()
+			}
+		}
+	})
+}
+
+// resolvedHosts returns the addresses as hosts to open, IPv4 first like
+// preferIPv4 and otherwise in order.
+func resolvedHosts(addrs []netip.Addr) []string {
+	hosts := make([]string, 0, len(addrs))
+	for _, v4 := range []bool{true, false} {
+		for _, addr := range addrs {
+			if addr.Unmap().Is4() == v4 {
+				hosts = append(hosts, addr.String())
+			}
+		}
+	}
+	return hosts
+}
+
+// preferIPv4 returns the first IPv4 address, or the first address if there
+// is none.
+func preferIPv4(addrs []net.IPAddr) net.IP {
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP
+		}
+	}
+	return addrs[0].IP
+}
+
+// parseUDPHeader splits a client datagram into its destination and payload.
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+func parseUDPHeader(b []byte) (string, int, []byte, error) {
+	if len(b) < 4 {
+		return "", 0, nil, errors.New("short UDP header")
+	}
+	if b[2] != 0 {
+		return "", 0, nil, errUDPFragmented
+	}
+
+	var host string
+	rest := b[4:]
+	switch b[3] {
+	case addrTypeIPv4:
+		if len(rest) < net.IPv4len {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		host = net.IP(rest[:net.IPv4len]).String()
+		rest = rest[net.IPv4len:]
+
+	case addrTypeIPv6:
+		if len(rest) < net.IPv6len {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		host = net.IP(rest[:net.IPv6len]).String()
+		rest = rest[net.IPv6len:]
+
+	case addrTypeDomain:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		host = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+
+	default:
+		return "", 0, nil, fmt.Errorf("unsupported address type: %d", b[3])
+	}
+
+	if len(rest) < 2 {
+		return "", 0, nil, errors.New("short UDP header")
+	}
+	port := int(binary.BigEndian.Uint16(rest))
+	return host, port, rest[2:], nil
+}
+
+// appendUDPHeader appends a SOCKS5 UDP header for addr to b.
+func appendUDPHeader(b []byte, addr *net.UDPAddr) []byte {
+	b = append(b, 0, 0, 0) // RSV, FRAG
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, addrTypeIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, addrTypeIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
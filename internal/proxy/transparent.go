@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+// Transparent proxy modes, named after the firewall target that diverts the
+// connections.
+const (
+	TransparentRedirect = "redirect" // iptables/nftables REDIRECT; destination from SO_ORIGINAL_DST
+	TransparentTProxy   = "tproxy"   // TPROXY; the connection keeps its original destination
+)
+
+// TransparentServer accepts TCP connections diverted to it by the firewall,
+// recovers their original destination and routes them like SOCKS CONNECT
+// requests. Only the destination IP is known, so domain rules match only
+// through sniffing.
+type TransparentServer struct {
+	addr     string
+	mode     string
+	router   *router.Router
+	dialer   *network.InterfaceDialer
+	listener net.Listener
+	mu       sync.Mutex
+	running  bool
+}
+
+// NewTransparentServer creates a transparent proxy server for the mode
+// (TransparentRedirect or TransparentTProxy).
+func NewTransparentServer(addr, mode string, router *router.Router, dialer *network.InterfaceDialer) *TransparentServer {
+	return &TransparentServer{
+		addr:   addr,
+		mode:   mode,
+		router: router,
+		dialer: dialer,
+	}
+}
+
+// Start starts the transparent proxy server.
+func (t *TransparentServer) Start(ctx context.Context) error {
+	listener, err := listenTransparent(ctx, t.mode, t.addr)
+	if err != nil {
+		return fmt.Errorf("failed to start %s proxy: %w", t.mode, err)
+	}
+
+	t.mu.Lock()
+	t.listener = listener
+	t.running = true
+	t.mu.Unlock()
+
+	logging.Info("Transparent proxy listening", "addr", t.addr, "mode", t.mode)
+
+	go func() {
+		<-ctx.Done()
+		t.Stop()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.mu.Lock()
+			running := t.running
+			t.mu.Unlock()
+
+			if !running {
+				return nil
+			}
+			logging.Error("Failed to accept connection", "error", err)
+			continue
+		}
+
+		go t.handleConnection(conn)
+	}
+}
+
+// Stop stops the transparent proxy server.
+func (t *TransparentServer) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running = false
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+// handleConnection relays a diverted connection to its original destination.
+func (t *TransparentServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := originalDestination(conn, t.mode)
+	if err != nil {
+		logging.Warn("Failed to get original destination", "client", conn.RemoteAddr().String(), "mode", t.mode, "error", err)
+		return
+	}
+	if t.isListener(dst) {
+		// Dialing it would connect back to ourselves
+		logging.Warn("Refusing connection that was not diverted", "client", conn.RemoteAddr().String(), "target", dst.String())
+		return
+	}
+
+	host, port := dst.IP.String(), dst.Port
+	req := router.Request{Host: host, Port: port}
+	result := t.router.Route(req)
+	var domain string
+	if result.Sniff {
+		result, domain, conn = sniffRoute(t.router, conn, req, result)
+	}
+	logging.Info("Routing connection", "target", host, "port", port, "domain", domain, "protocol", t.mode, "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	remote, err := dialRoute(context.Background(), t.dialer, result, target)
+	if err != nil {
+		logging.Warn("Failed to connect", "target", target, "error", err)
+		return
+	}
+	defer remote.Close()
+
+	relay(conn, remote)
+}
+
+// isListener reports whether dst is the listener's own address, i.e. the
+// client connected to the port directly instead of being diverted.
+func (t *TransparentServer) isListener(dst *net.TCPAddr) bool {
+	t.mu.Lock()
+	local, ok := t.listener.Addr().(*net.TCPAddr)
+	t.mu.Unlock()
+
+	if !ok || dst.Port != local.Port {
+		return false
+	}
+	if local.IP.IsUnspecified() {
+		return dst.IP.IsLoopback() || dst.IP.IsUnspecified()
+	}
+	return dst.IP.Equal(local.IP)
+}
+
+// Addr returns the address the server is listening on.
+func (t *TransparentServer) Addr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener != nil {
+		return t.listener.Addr().String()
+	}
+	return t.addr
+}
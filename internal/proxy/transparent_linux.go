@@ -0,0 +1,118 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Socket options not exported by syscall (linux/netfilter_ipv4.h,
+// linux/netfilter_ipv6/ip6_tables.h, linux/in6.h).
+const (
+	soOriginalDst     = 80
+	ip6tSOOriginalDst = 80
+	ipv6Transparent   = 75
+)
+
+// listenTransparent opens the listener for a transparent proxy mode. TPROXY
+// listeners set IP_TRANSPARENT so they can accept connections addressed to
+// other hosts.
+func listenTransparent(ctx context.Context, mode, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if mode == TransparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			}); err != nil {
+				return err
+			}
+			if errors.Is(sockErr, syscall.EPERM) {
+				return fmt.Errorf("set IP_TRANSPARENT: %w (run as root or grant CAP_NET_ADMIN)", sockErr)
+			}
+			if sockErr != nil {
+				return fmt.Errorf("set IP_TRANSPARENT: %w", sockErr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// originalDestination returns the address a diverted connection was sent to.
+// TPROXY leaves it as the local address; REDIRECT rewrites it, so it is
+// recovered from conntrack with SO_ORIGINAL_DST.
+func originalDestination(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	if mode == TransparentTProxy {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var dst *net.TCPAddr
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if ipv4 {
+			dst, sockErr = originalDestinationIPv4(int(fd))
+			if sockErr == nil {
+				return
+			}
+			// IPv4-mapped connection on a dual-stack socket
+		}
+		dst, sockErr = originalDestinationIPv6(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return dst, nil
+}
+
+// originalDestinationIPv4 reads the struct sockaddr_in returned by
+// SO_ORIGINAL_DST, using the 20-byte IPv6Mreq getter as a raw buffer.
+func originalDestinationIPv4(fd int) (*net.TCPAddr, error) {
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	// sin_family (2 bytes), sin_port (network order), sin_addr
+	raw := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+		Port: int(binary.BigEndian.Uint16(raw[2:4])),
+	}, nil
+}
+
+// originalDestinationIPv6 reads the struct sockaddr_in6 returned by
+// IP6T_SO_ORIGINAL_DST, whose layout IPv6MTUInfo starts with.
+func originalDestinationIPv6(fd int) (*net.TCPAddr, error) {
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, ip6tSOOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	// The port was copied in network byte order
+	var port [2]byte
+	binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+	return &net.TCPAddr{
+		IP:   net.IP(info.Addr.Addr[:]),
+		Port: int(binary.BigEndian.Uint16(port[:])),
+	}, nil
+}
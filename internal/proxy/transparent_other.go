@@ -0,0 +1,23 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+// listenTransparent reports that transparent proxying is unsupported on this
+// platform.
+func listenTransparent(ctx context.Context, mode, addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+// originalDestination reports that transparent proxying is unsupported on
+// this platform.
+func originalDestination(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
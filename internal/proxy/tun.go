@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+// tunFlow is a TCP connection or UDP flow captured from the TUN device. For
+// TCP, the handshake with the client only completes on accept, so a
+// destination that can't be reached is refused with a reset instead.
+type tunFlow struct {
+	network  string // "tcp" or "udp"
+	src, dst netip.AddrPort
+	accept   func() (net.Conn, error)
+	reject   func()
+}
+
+// TUNServer captures the traffic routed into a TUN device. A userspace
+// TCP/IP stack terminates its TCP connections and UDP flows, which are
+// routed like SOCKS5 requests. Only the destination IP is known, so domain
+// rules match only through sniffing.
+type TUNServer struct {
+	name   string
+	mtu    int
+	router *router.Router
+	dialer *network.InterfaceDialer
+	stack  io.Closer
+	mu     sync.Mutex
+}
+
+// NewTUNServer creates a TUN server for the configured device.
+func NewTUNServer(cfg config.TUNConfig, router *router.Router, dialer *network.InterfaceDialer) *TUNServer {
+	return &TUNServer{
+		name:   cfg.Name,
+		mtu:    cfg.DeviceMTU(),
+		router: router,
+		dialer: dialer,
+	}
+}
+
+// Start opens the device and handles its traffic until the context is
+// cancelled.
+func (t *TUNServer) Start(ctx context.Context) error {
+	stack, err := openTUNStack(t.name, t.mtu, t.handleFlow)
+	if err != nil {
+		return fmt.Errorf("failed to start TUN device %s: %w", t.name, err)
+	}
+
+	t.mu.Lock()
+	t.stack = stack
+	t.mu.Unlock()
+
+	logging.Info("TUN device capturing traffic", "device", t.name, "mtu", t.mtu)
+
+	<-ctx.Done()
+	return t.Stop()
+}
+
+// Stop closes the stack and the device.
+func (t *TUNServer) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stack == nil {
+		return nil
+	}
+	err := t.stack.Close()
+	t.stack = nil
+	return err
+}
+
+// handleFlow routes a captured flow by its destination.
+func (t *TUNServer) handleFlow(f tunFlow) {
+	if f.network == "udp" {
+		t.handleUDP(f)
+	} else {
+		t.handleTCP(f)
+	}
+}
+
+// handleTCP relays a captured TCP connection to its destination. Unless the
+// connection is sniffed, the destination is dialed before the handshake
+// with the client completes.
+func (t *TUNServer) handleTCP(f tunFlow) {
+	host, port := f.dst.Addr().String(), int(f.dst.Port())
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	req := router.Request{Host: host, Port: port}
+	result := t.router.Route(req)
+
+	var conn, remote net.Conn
+	var domain string
+	var err error
+	if result.Sniff {
+		if conn, err = f.accept(); err != nil {
+			logging.Debug("Failed to accept TUN connection", "target", target, "error", err)
+			return
+		}
+		result, domain, conn = sniffRoute(t.router, conn, req, result)
+	}
+	logging.Info("Routing connection", "target", host, "port", port, "domain", domain, "protocol", "tun", "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+
+	remote, err = dialRoute(context.Background(), t.dialer, result, target)
+	if err != nil {
+		logging.Warn("Failed to connect", "target", target, "error", err)
+		if conn != nil {
+			conn.Close()
+		} else {
+			f.reject()
+		}
+		return
+	}
+	defer remote.Close()
+
+	if conn == nil {
+		if conn, err = f.accept(); err != nil {
+			logging.Debug("Failed to accept TUN connection", "target", target, "error", err)
+			return
+		}
+	}
+	defer conn.Close()
+
+	relay(conn, remote)
+}
+
+// handleUDP relays a captured UDP flow to its destination until it has been
+// idle for udpFlowIdleTimeout. A flow whose route has Sniff set is held
+// until its first datagrams show whether it is QUIC.
+func (t *TUNServer) handleUDP(f tunFlow) {
+	conn, err := f.accept()
+	if err != nil {
+		logging.Debug("Failed to accept TUN flow", "target", f.dst.String(), "error", err)
+		return
+	}
+	defer conn.Close()
+
+	host, port := f.dst.Addr().String(), int(f.dst.Port())
+	req := router.Request{Host: host, Port: port}
+	result := t.router.Route(req)
+
+	var queue [][]byte
+	if result.Sniff {
+		var name string
+		name, queue = sniffUDPFlow(conn, t.router.SniffTimeout())
+		if name != "" {
+			req.Domain = name
+			result = t.router.Route(req)
+		}
+	}
+	logging.Info("Routing UDP", "target", host, "port", port, "domain", req.Domain, "protocol", "tun", "interface", result.Interface, "rule", result.RuleName, "fallback", result.Fallback)
+
+	remote, release, err := t.listenPacket(result, f.dst.String())
+	if err != nil {
+		logging.Warn("Failed to open UDP socket", "target", f.dst.String(), "error", err)
+		return
+	}
+	defer release()
+	defer remote.Close()
+
+	dst := net.UDPAddrFromAddrPort(f.dst)
+	for _, datagram := range queue {
+		remote.WriteTo(datagram, dst)
+	}
+
+	var lastUse atomic.Int64
+	lastUse.Store(time.Now().UnixNano())
+	// idle reports whether a read that timed out ends the flow, and extends
+	// the deadline otherwise
+	idle := func(c interface{ SetReadDeadline(time.Time) error }, err error) bool {
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return true
+		}
+		last := time.Unix(0, lastUse.Load())
+		if time.Since(last) >= udpFlowIdleTimeout {
+			return true
+		}
+		c.SetReadDeadline(last.Add(udpFlowIdleTimeout))
+		return false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, maxUDPPacketSize)
+		remote.SetReadDeadline(time.Now().Add(udpFlowIdleTimeout))
+		for {
+			n, from, err := remote.ReadFrom(buf)
+			if err != nil {
+				if idle(remote, err) {
+					conn.Close()
+					return
+				}
+				continue
+			}
+			if addr, ok := from.(*net.UDPAddr); !ok || unmapAddrPort(addr.AddrPort()) != f.dst {
+				// The flow is connected to one destination
+				continue
+			}
+			lastUse.Store(time.Now().UnixNano())
+			conn.Write(buf[:n])
+		}
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	conn.SetReadDeadline(time.Now().Add(udpFlowIdleTimeout))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if idle(conn, err) {
+				remote.Close()
+				break
+			}
+			continue
+		}
+		lastUse.Store(time.Now().UnixNano())
+		remote.WriteTo(buf[:n], dst)
+	}
+	<-done
+}
+
+// unmapAddrPort unmaps an IPv4-mapped IPv6 address.
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// sniffUDPFlow reads the first datagrams of a flow, for up to timeout, until
+// they show the QUIC server name or that there is none. It returns the name
+// and the datagrams read.
+func sniffUDPFlow(conn net.Conn, timeout time.Duration) (string, [][]byte) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var queue [][]byte
+	for {
+		buf := make([]byte, maxUDPPacketSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", queue
+		}
+		queue = append(queue, buf[:n])
+		if name, done := sniffQUIC(queue); done {
+			return name, queue
+		}
+	}
+}
+
+// listenPacket opens the UDP socket for a flow to target on the routed
+// interface, applying the route's on_interface_down policy like dialRoute.
+// It returns the socket and the function releasing the route.
+func (t *TUNServer) listenPacket(result router.RouteResult, target string) (net.PacketConn, func(), error) {
+	ctx := context.Background()
+
+	var reason error
+	if result.Unhealthy {
+		reason = fmt.Errorf("interface %s is unhealthy", result.Interface)
+	} else {
+		conn, err := t.dialer.ListenPacket(ctx, result.Interface, target)
+		if err == nil {
+			return conn, result.Acquire(), nil
+		}
+		result.Failed()
+		if !errors.Is(err, network.ErrInterfaceUnavailable) {
+			return nil, nil, err
+		}
+		reason = err
+	}
+
+	uplink, err := interfaceDownRoute(result, target, reason)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conn net.PacketConn
+	if uplink == "" {
+		conn, err = t.dialer.ListenPacketDefault(ctx)
+	} else {
+		conn, err = t.dialer.ListenPacket(ctx, uplink, target)
+	}
+	return conn, func() {}, err
+}
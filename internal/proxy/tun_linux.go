@@ -0,0 +1,169 @@
+//go:build linux
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"github.com/waylen888/splitdial/internal/logging"
+)
+
+const (
+	// tunNIC is the ID of the stack's only NIC, the TUN device.
+	tunNIC tcpip.NICID = 1
+
+	// maxTUNConnecting bounds the TCP connections being dialed before their
+	// handshake with the client completes; further SYNs are dropped.
+	maxTUNConnecting = 1024
+)
+
+// tunStack is a gVisor network stack attached to a TUN device.
+type tunStack struct {
+	stack *stack.Stack
+	fd    int
+}
+
+// openTUNStack opens the TUN device, creating it if needed, brings it up
+// with the MTU and attaches a stack that accepts connections to any
+// address. Each TCP connection and UDP flow is passed to handle in its own
+// goroutine.
+func openTUNStack(name string, mtu int, handle func(tunFlow)) (io.Closer, error) {
+	fd, err := tun.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := setLinkUp(name, mtu); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(mtu), RXChecksumOffload: true})
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	ts := &tunStack{stack: s, fd: fd}
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+	tcpForwarder := tcp.NewForwarder(s, 0, maxTUNConnecting, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		handle(tunFlow{
+			network: "tcp",
+			src:     endpointAddr(id.RemoteAddress, id.RemotePort),
+			dst:     endpointAddr(id.LocalAddress, id.LocalPort),
+			accept: func() (net.Conn, error) {
+				var wq waiter.Queue
+				ep, err := r.CreateEndpoint(&wq)
+				if err != nil {
+					r.Complete(true)
+					return nil, errors.New(err.String())
+				}
+				r.Complete(false)
+				return gonet.NewTCPConn(&wq, ep), nil
+			},
+			reject: func() { r.Complete(true) },
+		})
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) bool {
+		// Create the endpoint right away, so the flow's next datagrams
+		// reach it instead of starting new flows
+		id := r.ID()
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			logging.Debug("Failed to create TUN UDP endpoint", "target", endpointAddr(id.LocalAddress, id.LocalPort).String(), "error", err)
+			return true
+		}
+		conn := gonet.NewUDPConn(&wq, ep)
+		go handle(tunFlow{
+			network: "udp",
+			src:     endpointAddr(id.RemoteAddress, id.RemotePort),
+			dst:     endpointAddr(id.LocalAddress, id.LocalPort),
+			accept:  func() (net.Conn, error) { return conn, nil },
+			reject:  func() { conn.Close() },
+		})
+		return true
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	// The NIC delivers packets once enabled, so it is configured first
+	if err := s.CreateNICWithOptions(tunNIC, ep, stack.NICOptions{Disabled: true}); err != nil {
+		ts.Close()
+		return nil, errors.New(err.String())
+	}
+	// Accept packets to any address, and reply from it
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+	if err := s.EnableNIC(tunNIC); err != nil {
+		ts.Close()
+		return nil, errors.New(err.String())
+	}
+
+	return ts, nil
+}
+
+// Close closes the stack, its connections and the device.
+func (ts *tunStack) Close() error {
+	ts.stack.Close()
+	ts.stack.Wait()
+	return unix.Close(ts.fd)
+}
+
+// endpointAddr converts a stack address and port.
+func endpointAddr(addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return netip.AddrPortFrom(ip.Unmap(), port)
+}
+
+// setLinkUp sets the device's MTU and brings it up.
+func setLinkUp(name string, mtu int) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	ifr.SetUint32(uint32(mtu))
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFMTU, ifr); err != nil {
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to get flags: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to bring up: %w", err)
+	}
+	return nil
+}
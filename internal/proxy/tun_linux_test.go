@@ -0,0 +1,245 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/waylen888/splitdial/internal/config"
+	"github.com/waylen888/splitdial/internal/logging"
+	"github.com/waylen888/splitdial/internal/network"
+	"github.com/waylen888/splitdial/internal/router"
+)
+
+// TestTUNServer captures a client in its own network namespace, whose
+// route to the server subnet points into the TUN device, and checks that
+// its TCP and UDP traffic reaches echo servers through the uplink in the
+// test's namespace.
+func TestTUNServer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("no /dev/net/tun")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("no ip command")
+	}
+
+	id := os.Getpid() % 100000
+	tunName := fmt.Sprintf("sdtun%d", id)
+	uplink := fmt.Sprintf("sdup%d", id)
+	ns := fmt.Sprintf("splitdial-test-%d", id)
+
+	// The uplink holds the echo servers' address. It is one end of a veth
+	// pair, as dummy devices need a kernel module.
+	runIP(t, "link", "add", uplink, "type", "veth", "peer", "name", uplink+"p")
+	t.Cleanup(func() { exec.Command("ip", "link", "del", uplink).Run() })
+	runIP(t, "addr", "add", "10.233.0.1/32", "dev", uplink)
+	runIP(t, "link", "set", uplink, "up")
+
+	tcpAddr := startTCPEcho(t, "10.233.0.1:0")
+	udpAddr := startUDPEcho(t, "10.233.0.1:0")
+	closedAddr := closedTCPAddr(t, "10.233.0.1:0")
+
+	// Set up logging before the handlers log concurrently, as main does
+	logging.Init(nil)
+	im := network.NewInterfaceManager(map[string]network.Uplink{
+		"up": {Device: uplink, Bind: config.BindIP},
+	})
+	srv := NewTUNServer(config.TUNConfig{Name: tunName}, router.NewRouter(nil, "up"), network.NewInterfaceDialer(im, 5*time.Second))
+	ctx, cancel := context.WithCancel(t.Context())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	})
+	waitLinkUp(t, tunName, errc)
+
+	runIP(t, "netns", "add", ns)
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", ns).Run() })
+	runIP(t, "link", "set", tunName, "netns", ns)
+	runIP(t, "-n", ns, "link", "set", tunName, "up")
+	runIP(t, "-n", ns, "addr", "add", "10.234.0.2/24", "dev", tunName)
+	runIP(t, "-n", ns, "route", "add", "10.233.0.0/24", "dev", tunName)
+
+	t.Run("tcp", func(t *testing.T) {
+		conn, err := dialInNetns(ns, "tcp", tcpAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectEcho(t, conn, []byte("hello over tcp"))
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := dialInNetns(ns, "udp", udpAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for i := range 3 {
+			expectEcho(t, conn, fmt.Appendf(nil, "datagram %d", i))
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		conn, err := dialInNetns(ns, "tcp", closedAddr)
+		if err == nil {
+			conn.Close()
+			t.Fatal("dial to a closed port succeeded")
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("dial to a closed port: %v, want connection refused", err)
+		}
+	})
+}
+
+func runIP(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %v: %v: %s", args, err, out)
+	}
+}
+
+// waitLinkUp waits for the server to bring the device up.
+func waitLinkUp(t *testing.T, name string, errc chan error) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if ifi, err := net.InterfaceByName(name); err == nil && ifi.Flags&net.FlagUp != 0 {
+			return
+		}
+		select {
+		case err := <-errc:
+			errc <- err
+			t.Fatalf("Start: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("device %s did not come up", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialInNetns dials from the named network namespace. The socket stays in
+// that namespace after the dialing thread switches back.
+func dialInNetns(ns, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// The thread is left locked, and so discarded, unless it is back in
+		// its own namespace
+		runtime.LockOSThread()
+		orig, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer orig.Close()
+		target, err := os.Open("/var/run/netns/" + ns)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer target.Close()
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			done <- result{err: err}
+			return
+		}
+		conn, err := net.DialTimeout(network, address, 5*time.Second)
+		if unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		done <- result{conn, err}
+	}()
+	r := <-done
+	return r.conn, r.err
+}
+
+func expectEcho(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func startTCPEcho(t *testing.T, addr string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startUDPEcho(t *testing.T, addr string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// closedTCPAddr returns an address nothing listens on.
+func closedTCPAddr(t *testing.T, addr string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
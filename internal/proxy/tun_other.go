@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+// openTUNStack reports that TUN mode is unsupported on this platform.
+func openTUNStack(name string, mtu int, handle func(tunFlow)) (io.Closer, error) {
+	return nil, errors.New("TUN mode is only supported on Linux")
+}
@@ -0,0 +1,207 @@
+package router
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+// MemberStats holds load-balancing counters for one interface in a group.
+type MemberStats struct {
+	Interface string `json:"interface"`
+	Weight    int    `json:"weight"`
+	Healthy   bool   `json:"healthy"`
+	Active    int64  `json:"active"`   // connections currently in use; idle pooled HTTP connections are not counted
+	Total     uint64 `json:"total"`    // connections opened
+	Failures  uint64 `json:"failures"` // dials that failed
+}
+
+// BalancerStats holds the load-balancing state of a rule.
+type BalancerStats struct {
+	RuleID   string        `json:"rule_id"`
+	RuleName string        `json:"rule_name"`
+	Strategy string        `json:"strategy"`
+	Members  []MemberStats `json:"members"`
+}
+
+// member is an interface in a load-balanced group.
+type member struct {
+	name          string
+	weight        int
+	currentWeight int // smooth weighted round-robin state, guarded by balancer.mu
+
+	*memberCounters
+}
+
+// memberCounters are the connection counters of a group member. They are
+// shared with the member that replaces it on reload, so connections opened
+// before the reload are released from the counters that now report them.
+type memberCounters struct {
+	active   atomic.Int64
+	total    atomic.Uint64
+	failures atomic.Uint64
+}
+
+// balancer distributes a rule's connections across its interface group.
+type balancer struct {
+	ruleID   string
+	ruleName string
+	strategy string
+	members  []*member
+
+	mu   sync.Mutex
+	next int // round-robin position
+}
+
+// newBalancer creates a balancer for a group rule. Counters are shared with
+// prev (the rule's balancer before a reload) for interfaces still in the
+// group.
+func newBalancer(rule config.RouteRule, prev *balancer) *balancer {
+	b := &balancer{
+		ruleID:   rule.ID,
+		ruleName: rule.Name,
+		strategy: rule.Strategy,
+	}
+	if b.strategy == "" {
+		b.strategy = config.StrategyRoundRobin
+	}
+
+	for _, name := range rule.Interfaces {
+		weight := rule.Weights[name]
+		if weight <= 0 {
+			weight = 1
+		}
+		m := &member{name: name, weight: weight, memberCounters: &memberCounters{}}
+		if prev != nil {
+			if old := prev.member(name); old != nil {
+				m.memberCounters = old.memberCounters
+			}
+		}
+		b.members = append(b.members, m)
+	}
+	return b
+}
+
+// member returns the group member with the given interface name, or nil.
+func (b *balancer) member(name string) *member {
+	for _, m := range b.members {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// healthyMembers returns the names of the healthy members in configured order.
+func (b *balancer) healthyMembers(healthy func(string) bool) []string {
+	var names []string
+	for _, m := range b.members {
+		if healthy(m.name) {
+			names = append(names, m.name)
+		}
+	}
+	return names
+}
+
+// pick chooses an interface for a connection to host. Unhealthy members are
+// skipped; ok is false if no member is healthy.
+func (b *balancer) pick(host string, healthy func(string) bool) (name string, ok bool) {
+	var candidates []*member
+	for _, m := range b.members {
+		if healthy(m.name) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	switch b.strategy {
+	case config.StrategyWeighted:
+		return b.pickWeighted(candidates).name, true
+	case config.StrategyLeastConnections:
+		return pickLeastConnections(candidates).name, true
+	case config.StrategyHash:
+		return pickHash(candidates, host).name, true
+	default:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		m := candidates[b.next%len(candidates)]
+		b.next++
+		return m.name, true
+	}
+}
+
+// pickWeighted implements smooth weighted round-robin: each pick, every
+// candidate gains its weight and the highest is chosen and reduced by the
+// total, which interleaves picks in proportion to weight.
+func (b *balancer) pickWeighted(candidates []*member) *member {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	var best *member
+	for _, m := range candidates {
+		m.currentWeight += m.weight
+		total += m.weight
+		if best == nil || m.currentWeight > best.currentWeight {
+			best = m
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// pickLeastConnections returns the candidate with the fewest active
+// connections relative to its weight.
+func pickLeastConnections(candidates []*member) *member {
+	best := candidates[0]
+	for _, m := range candidates[1:] {
+		// Compare active/weight without division
+		if m.active.Load()*int64(best.weight) < best.active.Load()*int64(m.weight) {
+			best = m
+		}
+	}
+	return best
+}
+
+// pickHash returns the candidate chosen by rendezvous hashing of the host,
+// so a destination keeps its interface as long as that interface stays in
+// the healthy set, and only its share moves when membership changes.
+func pickHash(candidates []*member, host string) *member {
+	var best *member
+	var bestScore uint64
+	for _, m := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(m.name))
+		h.Write([]byte{0})
+		h.Write([]byte(host))
+		score := h.Sum64()
+		if best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// stats returns the balancer's counters.
+func (b *balancer) stats(healthy func(string) bool) BalancerStats {
+	st := BalancerStats{
+		RuleID:   b.ruleID,
+		RuleName: b.ruleName,
+		Strategy: b.strategy,
+	}
+	for _, m := range b.members {
+		st.Members = append(st.Members, MemberStats{
+			Interface: m.name,
+			Weight:    m.weight,
+			Healthy:   healthy(m.name),
+			Active:    m.active.Load(),
+			Total:     m.total.Load(),
+			Failures:  m.failures.Load(),
+		})
+	}
+	return st
+}
@@ -0,0 +1,42 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+func TestBalancerReloadSharesCounters(t *testing.T) {
+	rule := config.RouteRule{
+		ID:         "lb",
+		Interfaces: []string{"a", "b"},
+		Strategy:   config.StrategyLeastConnections,
+		Enabled:    true,
+	}
+	r := NewRouter([]config.RouteRule{rule}, "a")
+
+	res := r.Route(Request{Host: "example.com", Port: 443})
+	release := res.Acquire()
+
+	// Reloading the rules keeps the open connection on the same counters
+	r.UpdateRules([]config.RouteRule{rule})
+	if got := activeConnections(r, res.Interface); got != 1 {
+		t.Fatalf("active after reload = %d, want 1", got)
+	}
+
+	release()
+	if got := activeConnections(r, res.Interface); got != 0 {
+		t.Fatalf("active after release = %d, want 0", got)
+	}
+}
+
+func activeConnections(r *Router, name string) int64 {
+	for _, st := range r.BalancerStats() {
+		for _, m := range st.Members {
+			if m.Interface == name {
+				return m.Active
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// ruleTable holds the compiled enabled rules, in order, and an index over
+// their domain and IP conditions, so routing only checks the rules that can
+// match a request instead of scanning all of them.
+type ruleTable struct {
+	rules []compiledRule
+	index ruleIndex
+}
+
+// ruleIndex maps domain patterns and IP prefixes to the rules (by position
+// in ruleTable.rules) that require them. A rule with domain conditions is
+// indexed by them alone, since they must match whatever the host; a rule
+// with IP conditions but no domain conditions is indexed by its prefixes.
+// Every other rule, e.g. one matching only ports, users or rule sets, or
+// one that resolves domains, is always checked.
+type ruleIndex struct {
+	exact    map[string][]int
+	suffixes indexSuffixNode
+	globs    []indexGlob
+	v4, v6   indexIPNode
+	always   []int
+}
+
+// indexSuffixNode is a node of the reversed-label trie of "*." patterns; see
+// suffixNode.
+type indexSuffixNode struct {
+	children map[string]*indexSuffixNode
+	rules    []int // rules with a "*." pattern ending here
+}
+
+// indexGlob is a glob pattern and the rules using it.
+type indexGlob struct {
+	pattern string
+	rules   []int
+}
+
+// indexIPNode is a node of the binary prefix trie; see ipNode.
+type indexIPNode struct {
+	children [2]*indexIPNode
+	rules    []int // rules with a prefix ending here
+}
+
+// newRuleTable indexes the compiled rules.
+func newRuleTable(rules []compiledRule) *ruleTable {
+	t := &ruleTable{rules: rules, index: ruleIndex{exact: make(map[string][]int)}}
+	for i := range rules {
+		t.index.add(&rules[i], i)
+	}
+	return t
+}
+
+// add indexes the rule at position i.
+func (x *ruleIndex) add(c *compiledRule, i int) {
+	match := c.rule.Match
+	switch {
+	case c.domains != nil:
+		for _, pattern := range match.Domains {
+			x.addDomain(pattern, i)
+		}
+	case c.ips != nil && !c.rule.Resolve:
+		for _, cidr := range match.IPs {
+			x.addIP(cidr, i)
+		}
+	default:
+		x.always = append(x.always, i)
+	}
+}
+
+// addDomain indexes a domain pattern, classified like domainMatcher.add.
+func (x *ruleIndex) addDomain(pattern string, i int) {
+	pattern, kind := classifyDomainPattern(pattern)
+	switch kind {
+	case patternExact:
+		x.exact[pattern] = appendRule(x.exact[pattern], i)
+	case patternSuffix:
+		node := &x.suffixes
+		for label := range reversedLabels(pattern[2:]) {
+			child, ok := node.children[label]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*indexSuffixNode)
+				}
+				child = &indexSuffixNode{}
+				node.children[label] = child
+			}
+			node = child
+		}
+		node.rules = appendRule(node.rules, i)
+	default:
+		for k := range x.globs {
+			if x.globs[k].pattern == pattern {
+				x.globs[k].rules = appendRule(x.globs[k].rules, i)
+				return
+			}
+		}
+		x.globs = append(x.globs, indexGlob{pattern: pattern, rules: []int{i}})
+	}
+}
+
+// addIP indexes an IP address or CIDR prefix, parsed like ipTrie.add;
+// invalid entries are ignored.
+func (x *ruleIndex) addIP(cidr string, i int) {
+	prefix, ok := parseRulePrefix(cidr)
+	if !ok {
+		return
+	}
+
+	node := x.ipRoot(prefix.Addr())
+	raw := prefix.Addr().AsSlice()
+	for k := range prefix.Bits() {
+		b := addrBit(raw, k)
+		if node.children[b] == nil {
+			node.children[b] = &indexIPNode{}
+		}
+		node = node.children[b]
+	}
+	node.rules = appendRule(node.rules, i)
+}
+
+func (x *ruleIndex) ipRoot(addr netip.Addr) *indexIPNode {
+	if addr.Is4() {
+		return &x.v4
+	}
+	return &x.v6
+}
+
+// appendRule adds i to rules, which are added in increasing order, unless
+// it is already the last one (a rule listing a pattern twice).
+func appendRule(rules []int, i int) []int {
+	if len(rules) > 0 && rules[len(rules)-1] == i {
+		return rules
+	}
+	return append(rules, i)
+}
+
+// candidates returns the positions, in increasing order, of the rules that
+// may match the query: those whose indexed condition holds, and those that
+// are always checked.
+func (x *ruleIndex) candidates(q *query) []int {
+	result := slices.Clone(x.always)
+	result = append(result, x.exact[q.domain]...)
+
+	node := &x.suffixes
+	for label := range reversedLabels(q.domain) {
+		if node = node.children[label]; node == nil {
+			break
+		}
+		result = append(result, node.rules...)
+	}
+	for _, glob := range x.globs {
+		if matchDomain(glob.pattern, q.domain) {
+			result = append(result, glob.rules...)
+		}
+	}
+
+	if q.ip.IsValid() {
+		ipNode := x.ipRoot(q.ip)
+		raw := q.ip.AsSlice()
+		for k := 0; ipNode != nil; k++ {
+			result = append(result, ipNode.rules...)
+			if k == q.ip.BitLen() {
+				break
+			}
+			ipNode = ipNode.children[addrBit(raw, k)]
+		}
+	}
+
+	slices.Sort(result)
+	return slices.Compact(result)
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+// TestIndexMatchesScan checks that routing through the index picks the same
+// rule as checking every rule in order.
+func TestIndexMatchesScan(t *testing.T) {
+	rules := []config.RouteRule{
+		{ID: "exact", Interface: "a", Match: config.Match{Domains: []string{"Example.com", "example.com"}, Ports: []int{443}}},
+		{ID: "suffix", Interface: "b", Match: config.Match{Domains: []string{"*.example.com"}}},
+		{ID: "glob", Interface: "c", Match: config.Match{Domains: []string{"api-*.example.net"}}},
+		{ID: "cidr", Interface: "a", Match: config.Match{IPs: []string{"10.0.0.0/8", "::ffff:192.168.0.0/112"}}},
+		{ID: "host", Interface: "b", Match: config.Match{IPs: []string{"10.1.2.3", "2001:db8::/32"}, Ports: []int{22}}},
+		{ID: "both", Interface: "c", Match: config.Match{Domains: []string{"*.corp"}, IPs: []string{"172.16.0.0/12"}}},
+		{ID: "user", Interface: "a", Match: config.Match{Users: []string{"alice"}}},
+		{ID: "zero", Interface: "b", Match: config.Match{IPs: []string{"0.0.0.0/0"}, Ports: []int{25}}},
+		{ID: "all", Interface: "c"},
+	}
+	for i := range rules {
+		rules[i].Enabled = true
+	}
+	r := NewRouter(rules, "default")
+
+	hosts := []string{
+		"example.com", "EXAMPLE.com", "www.example.com", "example.org", "api-1.example.net",
+		"10.1.2.3", "10.9.9.9", "192.168.1.1", "172.16.5.5", "a.corp", "2001:db8::1", "1.1.1.1", "",
+	}
+	for _, host := range hosts {
+		for _, port := range []int{22, 25, 443} {
+			for _, user := range []string{"", "alice"} {
+				req := Request{Host: host, Port: port, User: user}
+				q := newQuery(req, nil)
+				got, _ := r.firstMatch(r.compiled, &q)
+
+				var want *compiledRule
+				for i := range r.compiled.rules {
+					if c := &r.compiled.rules[i]; c.match(&q) {
+						want = c
+						break
+					}
+				}
+				if got != want {
+					t.Errorf("%+v: index matched %v, scan matched %v", req, ruleID(got), ruleID(want))
+				}
+			}
+		}
+	}
+}
+
+func ruleID(c *compiledRule) string {
+	if c == nil {
+		return "none"
+	}
+	return c.rule.ID
+}
+
+// BenchmarkRoute routes requests through rule lists of growing size: one
+// rule with many domains, one with many CIDRs, and many single-domain or
+// single-CIDR rules. Each query hits the last entry or misses.
+func BenchmarkRoute(b *testing.B) {
+	for _, n := range []int{10, 1000, 50000} {
+		domains := make([]string, n)
+		cidrs := make([]string, n)
+		rng := rand.New(rand.NewPCG(1, uint64(n)))
+		for i := range n {
+			domains[i] = fmt.Sprintf("*.site%d.example", i)
+			cidrs[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(rng.IntN(256)), byte(rng.IntN(256)), 0}), 24).String()
+		}
+		lastDomain := fmt.Sprintf("www.site%d.example", n-1)
+		lastIP := netip.MustParsePrefix(cidrs[n-1]).Addr().Next().String()
+
+		manyRules := make([]config.RouteRule, 0, 2*n)
+		for i := range n {
+			manyRules = append(manyRules,
+				config.RouteRule{ID: fmt.Sprintf("d%d", i), Interface: "a", Enabled: true, Match: config.Match{Domains: domains[i : i+1]}},
+				config.RouteRule{ID: fmt.Sprintf("c%d", i), Interface: "b", Enabled: true, Match: config.Match{IPs: cidrs[i : i+1]}},
+			)
+		}
+
+		cases := []struct {
+			name  string
+			rules []config.RouteRule
+		}{
+			{"domains", []config.RouteRule{{ID: "d", Interface: "a", Enabled: true, Match: config.Match{Domains: domains}}}},
+			{"cidrs", []config.RouteRule{{ID: "c", Interface: "b", Enabled: true, Match: config.Match{IPs: cidrs}}}},
+			{"rules", manyRules},
+		}
+		for _, tc := range cases {
+			r := NewRouter(tc.rules, "default")
+			for _, host := range []string{lastDomain, lastIP, "miss.example.org", "192.0.2.1"} {
+				b.Run(fmt.Sprintf("%s/%d/%s", tc.name, n, host), func(b *testing.B) {
+					req := Request{Host: host, Port: 443}
+					for b.Loop() {
+						r.Route(req)
+					}
+				})
+			}
+		}
+	}
+}
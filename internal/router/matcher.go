@@ -0,0 +1,460 @@
+package router
+
+import (
+	"iter"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+// compiledRule is a route rule with its match conditions compiled into
+// indexed structures, so matching costs the same however many domains, IPs
+// or ports a rule lists.
+type compiledRule struct {
+	rule     config.RouteRule
+	catchAll bool // no match conditions
+
+	domains *domainMatcher // nil without domain conditions
+	ips     *ipTrie        // nil without IP conditions
+	ports   *portSet       // nil without port conditions
+	users   map[string]bool
+	sets    []*ruleSetMatcher // nil without rule-set conditions
+
+	countries map[string]bool // upper-case ISO codes; nil without GeoIP conditions
+	asns      map[uint32]bool // nil without ASN conditions
+}
+
+// ruleSetMatcher is a compiled rule set; it matches a request whose domain
+// or IP address it lists.
+type ruleSetMatcher struct {
+	source  *config.RuleSet
+	domains *domainMatcher
+	ips     *ipTrie
+}
+
+// compileRuleSet compiles the entries of a loaded rule set.
+func compileRuleSet(rs *config.RuleSet) *ruleSetMatcher {
+	m := &ruleSetMatcher{source: rs, domains: newDomainMatcher(), ips: &ipTrie{}}
+	for _, pattern := range rs.Domains {
+		m.domains.add(pattern)
+	}
+	for _, cidr := range rs.IPs {
+		m.ips.add(cidr)
+	}
+	return m
+}
+
+func (m *ruleSetMatcher) match(q *query) bool {
+	return m.domains.match(q.domain) || (q.ip.IsValid() && m.ips.contains(q.ip))
+}
+
+// compileRules compiles the enabled rules, in order, referencing the
+// compiled rule sets.
+func compileRules(rules []config.RouteRule, sets map[string]*ruleSetMatcher) []compiledRule {
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Enabled {
+			compiled = append(compiled, compileRule(rule, sets))
+		}
+	}
+	return compiled
+}
+
+// compileRule compiles a rule's match conditions. Unknown rule sets match
+// nothing.
+func compileRule(rule config.RouteRule, sets map[string]*ruleSetMatcher) compiledRule {
+	match := rule.Match
+	c := compiledRule{
+		rule: rule,
+		catchAll: len(match.Domains) == 0 && len(match.IPs) == 0 && len(match.Ports) == 0 && len(match.Users) == 0 &&
+			len(match.RuleSets) == 0 && len(match.GeoIP) == 0 && len(match.ASN) == 0,
+	}
+
+	if len(match.Domains) > 0 {
+		c.domains = newDomainMatcher()
+		for _, pattern := range match.Domains {
+			c.domains.add(pattern)
+		}
+	}
+	if len(match.IPs) > 0 {
+		c.ips = &ipTrie{}
+		for _, cidr := range match.IPs {
+			c.ips.add(cidr)
+		}
+	}
+	if len(match.Ports) > 0 {
+		c.ports = &portSet{}
+		for _, port := range match.Ports {
+			c.ports.add(port)
+		}
+	}
+	if len(match.Users) > 0 {
+		c.users = make(map[string]bool, len(match.Users))
+		for _, user := range match.Users {
+			c.users[user] = true
+		}
+	}
+	if len(match.RuleSets) > 0 {
+		c.sets = make([]*ruleSetMatcher, 0, len(match.RuleSets))
+		for _, name := range match.RuleSets {
+			if set, ok := sets[name]; ok {
+				c.sets = append(c.sets, set)
+			}
+		}
+	}
+	if len(match.GeoIP) > 0 {
+		c.countries = make(map[string]bool, len(match.GeoIP))
+		for _, code := range match.GeoIP {
+			c.countries[strings.ToUpper(code)] = true
+		}
+	}
+	if len(match.ASN) > 0 {
+		c.asns = make(map[uint32]bool, len(match.ASN))
+		for _, asn := range match.ASN {
+			c.asns[asn] = true
+		}
+	}
+	return c
+}
+
+// query is a request prepared for matching against compiled rules.
+type query struct {
+	domain  string     // lowercased name matched by domain conditions
+	ip      netip.Addr // valid if the host is an IP address
+	port    int
+	user    string
+	sniffed bool // domain was sniffed from a connection to ip
+
+	// GeoIP lookups, done on first use
+	geoip      GeoIPSource
+	country    string
+	asn        uint32
+	hasCountry bool
+	hasASN     bool
+}
+
+// newQuery prepares req for matching. Domain conditions see the sniffed name
+// of connections to an IP address.
+func newQuery(req Request, geoip GeoIPSource) query {
+	q := query{domain: req.Host, port: req.Port, user: req.User, geoip: geoip}
+	if req.Domain != "" {
+		q.domain = req.Domain
+		q.sniffed = true
+	}
+	q.domain = strings.ToLower(q.domain)
+	if ip := net.ParseIP(req.Host); ip != nil {
+		addr, _ := netip.AddrFromSlice(ip)
+		q.ip = addr.Unmap()
+	}
+	return q
+}
+
+// countryOf returns the country of the query's IP address.
+func (q *query) countryOf() string {
+	if !q.hasCountry && q.geoip != nil {
+		q.country, q.hasCountry = q.geoip.Country(q.ip), true
+	}
+	return q.country
+}
+
+// asnOf returns the autonomous system number of the query's IP address.
+func (q *query) asnOf() uint32 {
+	if !q.hasASN && q.geoip != nil {
+		q.asn, q.hasASN = q.geoip.ASN(q.ip), true
+	}
+	return q.asn
+}
+
+// match checks if the rule matches the query.
+func (c *compiledRule) match(q *query) bool {
+	if c.catchAll {
+		return true
+	}
+
+	if c.domains != nil && !c.domains.match(q.domain) {
+		return false
+	}
+
+	if c.ips != nil || c.countries != nil || c.asns != nil {
+		if !q.ip.IsValid() {
+			// Host is a domain name, not an IP
+			// If this rule ONLY has IP conditions (no domain conditions),
+			// then it cannot match a domain name
+			if c.domains == nil {
+				return false
+			}
+			// Otherwise, skip IP matching (domain already matched above)
+		} else if !c.matchIP(q) {
+			return false
+		}
+	}
+
+	if c.ports != nil && !c.ports.contains(q.port) {
+		return false
+	}
+
+	if c.users != nil && !c.users[q.user] {
+		return false
+	}
+
+	if c.sets != nil && !slices.ContainsFunc(c.sets, func(set *ruleSetMatcher) bool { return set.match(q) }) {
+		return false
+	}
+
+	return true
+}
+
+// matchIP checks the IP, GeoIP and ASN conditions against the query's IP
+// address.
+func (c *compiledRule) matchIP(q *query) bool {
+	if c.ips != nil && !c.ips.contains(q.ip) {
+		return false
+	}
+	if c.countries != nil && !c.countries[q.countryOf()] {
+		return false
+	}
+	if c.asns != nil && !c.asns[q.asnOf()] {
+		return false
+	}
+	return true
+}
+
+// resolves reports whether the rule resolves the query's domain to match
+// its IP conditions: it has resolve set and IP or rule-set conditions, the
+// host is a domain, and the rule's other conditions hold.
+func (c *compiledRule) resolves(q *query) bool {
+	if !c.rule.Resolve || q.ip.IsValid() || q.domain == "" {
+		return false
+	}
+	if c.ips == nil && c.countries == nil && c.asns == nil && c.sets == nil {
+		return false
+	}
+	return (c.domains == nil || c.domains.match(q.domain)) &&
+		(c.ports == nil || c.ports.contains(q.port)) &&
+		(c.users == nil || c.users[q.user])
+}
+
+// matchResolved matches the rule against each address the query's domain
+// resolved to, and returns those that match.
+func (c *compiledRule) matchResolved(q *query, addrs []netip.Addr) []netip.Addr {
+	var matched []netip.Addr
+	for _, addr := range addrs {
+		aq := *q
+		aq.ip, aq.hasCountry, aq.hasASN = addr, false, false
+		if c.match(&aq) {
+			matched = append(matched, addr)
+		}
+	}
+	return matched
+}
+
+// domainMatcher matches lowercased domain names against a rule's domain
+// patterns: exact names through a hash set, "*.example.com" wildcards
+// through a trie of reversed labels, and any other glob pattern one by one.
+type domainMatcher struct {
+	exact    map[string]bool
+	suffixes *suffixNode
+	globs    []string
+}
+
+// suffixNode is a node of the reversed-label trie; the path from the root
+// spells a domain from its last label.
+type suffixNode struct {
+	children map[string]*suffixNode
+	wildcard bool // a "*." pattern ends here: matches the name and all names under it
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{
+		exact:    make(map[string]bool),
+		suffixes: &suffixNode{},
+	}
+}
+
+// domainPatternKind is how a domain pattern is matched.
+type domainPatternKind int
+
+const (
+	patternExact  domainPatternKind = iota // a plain name
+	patternSuffix                          // "*.example.com": the name and all names under it
+	patternGlob                            // any other glob pattern
+)
+
+// classifyDomainPattern lowercases a domain pattern and reports how it is
+// matched. The domain matcher and the rule index both use it, so they agree.
+func classifyDomainPattern(pattern string) (string, domainPatternKind) {
+	const globChars = `*?[\`
+	pattern = strings.ToLower(pattern)
+	switch {
+	case !strings.ContainsAny(pattern, globChars):
+		return pattern, patternExact
+	case strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(pattern[2:], globChars):
+		return pattern, patternSuffix
+	default:
+		return pattern, patternGlob
+	}
+}
+
+// reversedLabels yields the labels of a domain from the last one, the path
+// of the domain in a reversed-label trie.
+func reversedLabels(domain string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for rest := domain; ; {
+			i := strings.LastIndexByte(rest, '.')
+			if !yield(rest[i+1:]) || i < 0 {
+				return
+			}
+			rest = rest[:i]
+		}
+	}
+}
+
+// add adds a domain pattern.
+func (m *domainMatcher) add(pattern string) {
+	pattern, kind := classifyDomainPattern(pattern)
+	switch kind {
+	case patternExact:
+		m.exact[pattern] = true
+	case patternSuffix:
+		node := m.suffixes
+		for label := range reversedLabels(pattern[2:]) {
+			child, ok := node.children[label]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*suffixNode)
+				}
+				child = &suffixNode{}
+				node.children[label] = child
+			}
+			node = child
+		}
+		node.wildcard = true
+	default:
+		m.globs = append(m.globs, pattern)
+	}
+}
+
+// match reports whether the lowercased domain matches any pattern.
+func (m *domainMatcher) match(domain string) bool {
+	if m.exact[domain] || m.matchSuffix(domain) {
+		return true
+	}
+	for _, pattern := range m.globs {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSuffix walks the domain's labels from the last one, matching if it
+// reaches a wildcard node.
+func (m *domainMatcher) matchSuffix(domain string) bool {
+	node := m.suffixes
+	for label := range reversedLabels(domain) {
+		if node = node.children[label]; node == nil {
+			return false
+		}
+		if node.wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// ipTrie is a binary trie of IP prefixes, one per address family, so a
+// lookup takes at most one step per address bit.
+type ipTrie struct {
+	v4, v6 ipNode
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	terminal bool // a prefix ends here: matches every address below it
+}
+
+// parseRulePrefix parses an IP address or CIDR prefix of a rule. IPv4-mapped
+// prefixes are unmapped, like the addresses they are matched against. The
+// IP trie and the rule index both use it, so they agree.
+func parseRulePrefix(cidr string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if addr, bits := prefix.Addr(), prefix.Bits(); addr.Is4In6() && bits >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), bits-96)
+	}
+	return prefix, true
+}
+
+// addrBit returns bit i, from the most significant, of an address.
+func addrBit(raw []byte, i int) byte {
+	return raw[i/8] >> (7 - i%8) & 1
+}
+
+// add adds an IP address or CIDR prefix; invalid entries are ignored.
+func (t *ipTrie) add(cidr string) {
+	prefix, ok := parseRulePrefix(cidr)
+	if !ok {
+		return
+	}
+
+	node := t.root(prefix.Addr())
+	raw := prefix.Addr().AsSlice()
+	for i := range prefix.Bits() {
+		if node.terminal {
+			// Already covered by a shorter prefix
+			return
+		}
+		b := addrBit(raw, i)
+		if node.children[b] == nil {
+			node.children[b] = &ipNode{}
+		}
+		node = node.children[b]
+	}
+	node.terminal = true
+	node.children = [2]*ipNode{}
+}
+
+// contains reports whether addr, which must be unmapped, is in any prefix.
+func (t *ipTrie) contains(addr netip.Addr) bool {
+	node := t.root(addr)
+	raw := addr.AsSlice()
+	for i := range addr.BitLen() {
+		if node.terminal {
+			return true
+		}
+		node = node.children[addrBit(raw, i)]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+func (t *ipTrie) root(addr netip.Addr) *ipNode {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// portSet is a bitmap of TCP/UDP ports.
+type portSet [65536 / 64]uint64
+
+func (s *portSet) add(port int) {
+	if port >= 0 && port <= 65535 {
+		s[port/64] |= 1 << (port % 64)
+	}
+}
+
+func (s *portSet) contains(port int) bool {
+	return port >= 0 && port <= 65535 && s[port/64]&(1<<(port%64)) != 0
+}
@@ -0,0 +1,68 @@
+package router
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestClassifyDomainPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		kind    domainPatternKind
+	}{
+		{"Example.COM", "example.com", patternExact},
+		{"*.Example.com", "*.example.com", patternSuffix},
+		{"*.*.example.com", "*.*.example.com", patternGlob},
+		{"*example.com", "*example.com", patternGlob},
+		{"api-?.example.com", "api-?.example.com", patternGlob},
+		{"[ab].example.com", "[ab].example.com", patternGlob},
+		{`example\.com`, `example\.com`, patternGlob},
+	}
+
+	for _, tt := range tests {
+		got, kind := classifyDomainPattern(tt.pattern)
+		if got != tt.want || kind != tt.kind {
+			t.Errorf("classifyDomainPattern(%q) = %q, %v; want %q, %v", tt.pattern, got, kind, tt.want, tt.kind)
+		}
+	}
+}
+
+func TestParseRulePrefix(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string // empty if invalid
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"::ffff:192.168.0.0/112", "192.168.0.0/16"},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+		// Too short to be IPv4-only
+		{"::ffff:0.0.0.0/95", "::ffff:0.0.0.0/95"},
+		{"10.0.0.0/33", ""},
+		{"example.com", ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseRulePrefix(tt.cidr)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("parseRulePrefix(%q) = %v, want invalid", tt.cidr, got)
+			}
+			continue
+		}
+		if want := netip.MustParsePrefix(tt.want); !ok || got != want {
+			t.Errorf("parseRulePrefix(%q) = %v, %v; want %v", tt.cidr, got, ok, want)
+		}
+	}
+}
+
+func TestReversedLabels(t *testing.T) {
+	got := slices.Collect(reversedLabels("www.example.com"))
+	if want := []string{"com", "example", "www"}; !slices.Equal(got, want) {
+		t.Fatalf("reversedLabels() = %q, want %q", got, want)
+	}
+}
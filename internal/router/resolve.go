@@ -0,0 +1,123 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/waylen888/splitdial/internal/config"
+)
+
+const (
+	// maxResolveCacheEntries bounds the lookup cache; expired entries are
+	// dropped when it fills up, and everything if none has expired.
+	maxResolveCacheEntries = 4096
+
+	// resolveFailureTTL is how long a failed lookup is remembered, so an
+	// unreachable nameserver does not delay every connection by the timeout.
+	resolveFailureTTL = 30 * time.Second
+)
+
+// Resolver looks up a domain's addresses through an uplink, for rules with
+// resolve set.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, uplink, host string) ([]net.IPAddr, error)
+}
+
+// resolveCache remembers the addresses of looked-up domains per uplink.
+type resolveCache struct {
+	mu      sync.Mutex
+	entries map[resolveKey]resolveEntry
+}
+
+type resolveKey struct {
+	uplink, host string
+}
+
+type resolveEntry struct {
+	addrs   []netip.Addr // nil if the lookup failed
+	expires time.Time
+}
+
+func newResolveCache() *resolveCache {
+	return &resolveCache{entries: make(map[resolveKey]resolveEntry)}
+}
+
+// get returns the cached addresses of a domain.
+func (c *resolveCache) get(key resolveKey) ([]netip.Addr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+// put caches the addresses of a domain for ttl.
+func (c *resolveCache) put(key resolveKey, addrs []netip.Addr, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxResolveCacheEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxResolveCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = resolveEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+}
+
+// clear drops all cached lookups.
+func (c *resolveCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// lookup resolves host through uplink, using the cache. It returns no
+// addresses without a resolver or if the lookup fails.
+func (r *Router) lookup(uplink, host string) []netip.Addr {
+	r.mu.RLock()
+	resolver, cfg := r.resolver, r.resolve
+	r.mu.RUnlock()
+	if resolver == nil {
+		return nil
+	}
+
+	key := resolveKey{uplink: uplink, host: host}
+	if addrs, ok := r.resolveCache.get(key); ok {
+		return addrs
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ResolveTimeout())
+	defer cancel()
+	ipAddrs, err := resolver.LookupIPAddr(ctx, uplink, host)
+	if err != nil {
+		r.resolveCache.put(key, nil, min(cfg.ResolveCacheTTL(), resolveFailureTTL))
+		return nil
+	}
+	addrs := make([]netip.Addr, 0, len(ipAddrs))
+	for _, ip := range ipAddrs {
+		if addr, ok := netip.AddrFromSlice(ip.IP); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	r.resolveCache.put(key, addrs, cfg.ResolveCacheTTL())
+	return addrs
+}
+
+// resolveUplink returns the uplink whose nameservers resolve domains for a
+// rule: its interface, or the first member of its group.
+func resolveUplink(rule config.RouteRule) string {
+	if rule.Interface == "" && len(rule.Interfaces) > 0 {
+		return rule.Interfaces[0]
+	}
+	return rule.Interface
+}
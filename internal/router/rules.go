@@ -1,23 +1,54 @@
 package router
 
 import (
-	"net"
+	"net/netip"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/waylen888/splitdial/internal/config"
 )
 
+// HealthSource reports whether an uplink is currently usable.
+type HealthSource interface {
+	IsHealthy(uplink string) bool
+}
+
+// GeoIPSource maps IP addresses to countries and autonomous systems, for
+// Match.GeoIP and Match.ASN.
+type GeoIPSource interface {
+	Country(ip netip.Addr) string // ISO 3166-1 code in upper case, empty if unknown
+	ASN(ip netip.Addr) uint32     // 0 if unknown
+}
+
 // Router handles traffic routing decisions based on rules.
 type Router struct {
-	rules []config.RouteRule
-	mu    sync.RWMutex
+	rules            []config.RouteRule
+	compiled         *ruleTable                 // enabled rules, in order
+	ruleSets         map[string]*ruleSetMatcher // compiled Match.RuleSets by name
+	balancers        map[string]*balancer       // rule ID -> balancer for group rules
+	defaultInterface string
+	onInterfaceDown  string
+	health           HealthSource
+	geoip            GeoIPSource
+	sniff            config.SniffConfig
+	resolver         Resolver
+	resolve          config.ResolveConfig
+	resolveCache     *resolveCache
+	mu               sync.RWMutex
 }
 
 // NewRouter creates a new router with the given rules.
-func NewRouter(rules []config.RouteRule) *Router {
-	return &Router{rules: rules}
+// defaultInterface is used when no rule matches.
+func NewRouter(rules []config.RouteRule, defaultInterface string) *Router {
+	return &Router{
+		rules:            rules,
+		compiled:         newRuleTable(compileRules(rules, nil)),
+		balancers:        buildBalancers(rules, nil),
+		defaultInterface: defaultInterface,
+		resolveCache:     newResolveCache(),
+	}
 }
 
 // UpdateRules updates the routing rules.
@@ -25,121 +56,317 @@ func (r *Router) UpdateRules(rules []config.RouteRule) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.rules = rules
+	r.compiled = newRuleTable(compileRules(rules, r.ruleSets))
+	r.balancers = buildBalancers(rules, r.balancers)
 }
 
-// RouteResult represents the result of a routing decision.
-type RouteResult struct {
-	Interface string // "cable" or "wifi"
-	RuleID    string // ID of the matched rule
-	RuleName  string // Name of the matched rule
+// SetRuleSets sets the rule sets referenced by Match.RuleSets. Rule sets
+// that are unchanged since the last call are not recompiled.
+func (r *Router) SetRuleSets(sets map[string]*config.RuleSet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	compiled := make(map[string]*ruleSetMatcher, len(sets))
+	for name, rs := range sets {
+		if prev, ok := r.ruleSets[name]; ok && prev.source == rs {
+			compiled[name] = prev
+		} else {
+			compiled[name] = compileRuleSet(rs)
+		}
+	}
+	r.ruleSets = compiled
+	r.compiled = newRuleTable(compileRules(r.rules, compiled))
 }
 
-// Route determines which interface to use for the given destination.
-func (r *Router) Route(host string, port int) RouteResult {
+// buildBalancers creates a balancer for each group rule, keeping counters
+// from prev for rules and interfaces that still exist.
+func buildBalancers(rules []config.RouteRule, prev map[string]*balancer) map[string]*balancer {
+	balancers := make(map[string]*balancer)
+	for _, rule := range rules {
+		if rule.IsGroup() {
+			balancers[rule.ID] = newBalancer(rule, prev[rule.ID])
+		}
+	}
+	return balancers
+}
+
+// BalancerStats returns the load-balancing state of every group rule.
+func (r *Router) BalancerStats() []BalancerStats {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	var result []BalancerStats
 	for _, rule := range r.rules {
-		if !rule.Enabled {
-			continue
+		if b, ok := r.balancers[rule.ID]; ok {
+			result = append(result, b.stats(r.isHealthy))
 		}
+	}
+	return result
+}
 
-		if r.matchRule(rule, host, port) {
-			return RouteResult{
-				Interface: rule.Interface,
-				RuleID:    rule.ID,
-				RuleName:  rule.Name,
-			}
-		}
+// SetDefaultInterface changes the interface used when no rule matches.
+func (r *Router) SetDefaultInterface(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.defaultInterface = name
+}
+
+// SetInterfaceDownPolicy sets the on_interface_down policy used by rules
+// that do not define their own.
+func (r *Router) SetInterfaceDownPolicy(policy string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onInterfaceDown = policy
+}
+
+// SetSniff sets the default for sniffing connections to IP addresses, used
+// by rules without their own sniff setting.
+func (r *Router) SetSniff(sniff config.SniffConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sniff = sniff
+}
+
+// SniffTimeout returns how long to wait for a client's first bytes when
+// sniffing.
+func (r *Router) SniffTimeout() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sniff.SniffTimeout()
+}
+
+// SetHealthSource sets the source used to skip unhealthy interfaces.
+func (r *Router) SetHealthSource(health HealthSource) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.health = health
+}
+
+// SetGeoIP sets the source used by GeoIP and ASN conditions. Without one,
+// those conditions match nothing.
+func (r *Router) SetGeoIP(geoip GeoIPSource) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.geoip = geoip
+}
+
+// SetResolver sets the resolver used by rules with resolve set. Without one,
+// those rules match domains as if resolve was not set.
+func (r *Router) SetResolver(resolver Resolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolver = resolver
+}
+
+// SetResolve sets the timeout and cache lifetime of lookups for rules with
+// resolve set, and drops the cached lookups.
+func (r *Router) SetResolve(resolve config.ResolveConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolve = resolve
+	r.resolveCache.clear()
+}
+
+// RouteResult represents the result of a routing decision.
+type RouteResult struct {
+	Interface string // name of the configured uplink
+	RuleID    string // ID of the matched rule
+	RuleName  string // Name of the matched rule
+	Fallback  bool   // true if Interface is a fallback because the primary is unhealthy
+	Unhealthy bool   // true if Interface and all its fallbacks are unhealthy
+
+	// OnInterfaceDown is the policy to apply if Interface is unavailable.
+	OnInterfaceDown string
+
+	// Sniff is set when the destination is an IP address and the matched
+	// rule asks for its server name to be sniffed and the request routed
+	// again with it as Request.Domain.
+	Sniff bool
+
+	// Addrs holds the resolved addresses of a domain Host that matched a
+	// rule with resolve set, to dial instead of looking Host up again.
+	Addrs []netip.Addr
+
+	// Candidates lists the healthy interfaces to race, in order, for rules
+	// using the "race" strategy. Interface is the first candidate.
+	Candidates []string
+	RaceDelay  time.Duration // stagger between race attempts
+
+	member *member   // set when Interface was picked from a load-balanced group
+	group  *balancer // set for load-balanced rules
+}
+
+// WithInterface returns the result with Interface set to name, which must be
+// one of the Candidates, e.g. the one that won a race.
+func (res RouteResult) WithInterface(name string) RouteResult {
+	res.Interface = name
+	if res.group != nil {
+		res.member = res.group.member(name)
 	}
+	return res
+}
 
-	// Default to cable if no rule matches
-	return RouteResult{
-		Interface: "cable",
-		RuleID:    "default",
-		RuleName:  "Default",
+// Acquire records a connection opened through a load-balanced interface.
+// The returned function must be called when the connection closes.
+func (res RouteResult) Acquire() func() {
+	if res.member != nil {
+		res.member.total.Add(1)
 	}
+	return res.Activate()
 }
 
-// matchRule checks if a rule matches the given destination.
-func (r *Router) matchRule(rule config.RouteRule, host string, port int) bool {
-	match := rule.Match
+// Activate counts a connection through a load-balanced interface as active
+// without counting a new connection, e.g. when a pooled connection serves
+// another request. The returned function must be called when it goes idle.
+func (res RouteResult) Activate() func() {
+	m := res.member
+	if m == nil {
+		return func() {}
+	}
+	m.active.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { m.active.Add(-1) })
+	}
+}
 
-	// If no match conditions, this is likely a catch-all rule
-	if len(match.Domains) == 0 && len(match.IPs) == 0 && len(match.Ports) == 0 {
-		return true
+// Failed records a failed dial through a load-balanced interface.
+func (res RouteResult) Failed() {
+	if res.member != nil {
+		res.member.failures.Add(1)
 	}
+}
 
-	// Check domains
-	if len(match.Domains) > 0 {
-		matched := false
-		for _, pattern := range match.Domains {
-			if matchDomain(pattern, host) {
-				matched = true
-				break
-			}
-		}
-		if !matched {
-			return false
-		}
+// Request describes a connection to be routed.
+type Request struct {
+	Host   string // destination domain or IP
+	Port   int    // destination port
+	User   string // authenticated user name, empty if the client did not authenticate
+	Domain string // server name sniffed from a connection to an IP Host; matched by domain rules
+}
+
+// Route determines which interface to use for the given request.
+func (r *Router) Route(req Request) RouteResult {
+	r.mu.RLock()
+	compiled, geoip := r.compiled, r.geoip
+	r.mu.RUnlock()
+
+	// Match without holding the lock, since rules with resolve set may look
+	// the domain up
+	q := newQuery(req, geoip)
+	c, addrs := r.firstMatch(compiled, &q)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if c != nil {
+		result := r.resultFor(c.rule, req.Host)
+		result.Sniff = r.sniffs(c.rule.Sniff, q)
+		result.Addrs = addrs
+		return result
 	}
 
-	// Check IPs
-	if len(match.IPs) > 0 {
-		ip := net.ParseIP(host)
-		if ip == nil {
-			// Host is a domain name, not an IP
-			// If this rule ONLY has IP conditions (no domain conditions),
-			// then it cannot match a domain name
-			if len(match.Domains) == 0 {
-				return false
-			}
-			// Otherwise, skip IP matching (domain already matched above)
-		} else {
-			matched := false
-			for _, cidr := range match.IPs {
-				_, ipNet, err := net.ParseCIDR(cidr)
-				if err != nil {
-					// Try as single IP
-					if net.ParseIP(cidr).Equal(ip) {
-						matched = true
-						break
-					}
-					continue
-				}
-				if ipNet.Contains(ip) {
-					matched = true
-					break
-				}
+	// Fall back to the default interface if no rule matches
+	return RouteResult{
+		Interface:       r.defaultInterface,
+		RuleID:          "default",
+		RuleName:        "Default",
+		Unhealthy:       !r.isHealthy(r.defaultInterface),
+		OnInterfaceDown: r.onInterfaceDown,
+		Sniff:           r.sniffs(nil, q),
+	}
+}
+
+// firstMatch returns the first rule that matches the query, and for rules
+// with resolve set the resolved addresses that matched, if any. Only the
+// rules the index finds candidates are checked.
+func (r *Router) firstMatch(table *ruleTable, q *query) (*compiledRule, []netip.Addr) {
+	for _, i := range table.index.candidates(q) {
+		c := &table.rules[i]
+		if c.resolves(q) {
+			if addrs := c.matchResolved(q, r.lookup(resolveUplink(c.rule), q.domain)); len(addrs) > 0 {
+				return c, addrs
 			}
-			if !matched {
-				return false
+			if c.ips != nil || c.countries != nil || c.asns != nil {
+				continue
 			}
+			// Rule sets may still list the domain itself
+		}
+		if c.match(q) {
+			return c, nil
 		}
 	}
+	return nil, nil
+}
 
-	// Check ports
-	if len(match.Ports) > 0 {
-		matched := false
-		for _, p := range match.Ports {
-			if p == port {
-				matched = true
-				break
+// sniffs reports whether a request routed by a rule with the given sniff
+// setting should be sniffed: only requests for an IP address that have not
+// been sniffed yet qualify.
+func (r *Router) sniffs(setting *bool, q query) bool {
+	if q.sniffed || !q.ip.IsValid() {
+		return false
+	}
+	if setting != nil {
+		return *setting
+	}
+	return r.sniff.Enabled
+}
+
+// resultFor builds the routing result for a matched rule. Group rules pick a
+// healthy member, or list all healthy members as race candidates; otherwise
+// the rule's interface is used, or the first healthy fallback if it is
+// unhealthy. If nothing is healthy, the primary (or first group member) is
+// returned marked Unhealthy.
+func (r *Router) resultFor(rule config.RouteRule, host string) RouteResult {
+	result := RouteResult{
+		Interface:       rule.Interface,
+		RuleID:          rule.ID,
+		RuleName:        rule.Name,
+		OnInterfaceDown: rule.OnInterfaceDown,
+	}
+	if result.OnInterfaceDown == "" {
+		result.OnInterfaceDown = r.onInterfaceDown
+	}
+
+	if b, ok := r.balancers[rule.ID]; ok {
+		result.group = b
+		if b.strategy == config.StrategyRace {
+			if candidates := b.healthyMembers(r.isHealthy); len(candidates) > 0 {
+				result.Candidates = candidates
+				result.RaceDelay = rule.RaceDelay
+				return result.WithInterface(candidates[0])
 			}
+		} else if name, ok := b.pick(host, r.isHealthy); ok {
+			return result.WithInterface(name)
 		}
-		if !matched {
-			return false
+		result = result.WithInterface(b.members[0].name)
+	} else if r.isHealthy(rule.Interface) {
+		return result
+	}
+
+	for _, name := range rule.Fallback {
+		if r.isHealthy(name) {
+			result.Interface = name
+			result.Fallback = true
+			result.member = nil
+			result.group = nil
+			return result
 		}
 	}
 
-	return true
+	result.Unhealthy = true
+	return result
 }
 
-// matchDomain checks if a domain matches a pattern with wildcard support.
-func matchDomain(pattern, domain string) bool {
-	pattern = strings.ToLower(pattern)
-	domain = strings.ToLower(domain)
+// isHealthy reports whether the uplink is healthy, or true without a health
+// source.
+func (r *Router) isHealthy(name string) bool {
+	return r.health == nil || r.health.IsHealthy(name)
+}
 
+// matchDomain checks if a lowercased domain matches a lowercased pattern
+// with wildcard support.
+func matchDomain(pattern, domain string) bool {
 	// Exact match
 	if pattern == domain {
 		return true
@@ -0,0 +1,97 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	maxMethodLen = 16
+	maxHeaderLen = 8192
+)
+
+// HTTP returns the host name an HTTP/1 request is for: the authority of an
+// absolute-form target, or else the Host header.
+func HTTP(data []byte) (string, error) {
+	method, _, ok := bytes.Cut(data, []byte(" "))
+	if !isMethod(method) {
+		return "", ErrNotFound
+	}
+	if !ok {
+		// Still reading the method
+		return "", ErrIncomplete
+	}
+	if len(method) == 0 {
+		return "", ErrNotFound
+	}
+
+	line, rest, ok := bytes.Cut(data, []byte("\r\n"))
+	if !ok {
+		return "", incomplete(data)
+	}
+	if !bytes.Contains(line, []byte(" HTTP/1.")) {
+		return "", ErrNotFound
+	}
+	// An absolute-form target's authority overrides the Host header (RFC
+	// 9112, section 3.2.2)
+	if _, target, _ := bytes.Cut(line, []byte(" ")); bytes.Contains(target, []byte("://")) {
+		target, _, _ = bytes.Cut(target, []byte(" "))
+		u, err := url.Parse(string(target))
+		if err != nil {
+			return "", ErrNotFound
+		}
+		if host := normalizeName(u.Hostname()); host != "" {
+			return host, nil
+		}
+		return "", ErrNotFound
+	}
+
+	for {
+		line, rest, ok = bytes.Cut(rest, []byte("\r\n"))
+		if !ok {
+			return "", incomplete(data)
+		}
+		if len(line) == 0 {
+			// End of the header without a Host
+			return "", ErrNotFound
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(name), "Host") {
+			continue
+		}
+
+		host := strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host = normalizeName(host); host == "" {
+			return "", ErrNotFound
+		}
+		return host, nil
+	}
+}
+
+// incomplete returns ErrIncomplete unless the header has grown too long to
+// be a request header.
+func incomplete(data []byte) error {
+	if len(data) > maxHeaderLen {
+		return ErrNotFound
+	}
+	return ErrIncomplete
+}
+
+// isMethod reports whether b looks like (the start of) an HTTP method: a
+// short run of uppercase letters.
+func isMethod(b []byte) bool {
+	if len(b) > maxMethodLen {
+		return false
+	}
+	for _, c := range b {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
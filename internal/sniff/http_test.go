@@ -0,0 +1,54 @@
+package sniff
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		err  error
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "www.example.com", nil},
+		{"host with port", "GET / HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\n", "www.example.com", nil},
+		{"host after other headers", "POST /api HTTP/1.1\r\nUser-Agent: test\r\nhost:  Example.COM. \r\n\r\n", "example.com", nil},
+		{"http/1.0", "GET / HTTP/1.0\r\nHost: www.example.com\r\n\r\n", "www.example.com", nil},
+		{"host line complete", "GET / HTTP/1.1\r\nHost: www.example.com\r\nAccept", "www.example.com", nil},
+		{"absolute form", "GET http://www.example.com/path HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "www.example.com", nil},
+		{"absolute form overrides host", "GET http://www.example.com:8080/ HTTP/1.1\r\nHost: other.example\r\n\r\n", "www.example.com", nil},
+		{"absolute form without headers", "GET http://www.example.com/ HTTP/1.0\r\n", "www.example.com", nil},
+		{"absolute form ip", "GET http://192.0.2.1/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "", ErrNotFound},
+
+		{"empty", "", "", ErrIncomplete},
+		{"partial method", "GE", "", ErrIncomplete},
+		{"partial request line", "GET /index.html HTT", "", ErrIncomplete},
+		{"partial header name", "GET / HTTP/1.1\r\nHo", "", ErrIncomplete},
+		{"partial host", "GET / HTTP/1.1\r\nHost: www.exam", "", ErrIncomplete},
+		{"before host", "GET / HTTP/1.1\r\nAccept: */*\r\n", "", ErrIncomplete},
+		{"header too long", "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", maxHeaderLen), "", ErrNotFound},
+
+		{"no host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", "", ErrNotFound},
+		{"ip host", "GET / HTTP/1.1\r\nHost: 192.0.2.1:80\r\n\r\n", "", ErrNotFound},
+		{"ipv6 host", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "", ErrNotFound},
+		{"empty host", "GET / HTTP/1.1\r\nHost: \r\n\r\n", "", ErrNotFound},
+		{"lowercase method", "get / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "", ErrNotFound},
+		{"no method", " / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "", ErrNotFound},
+		{"long method", strings.Repeat("A", maxMethodLen+1) + " / HTTP/1.1\r\n", "", ErrNotFound},
+		{"not http", "GET / FTP/1.0\r\nHost: www.example.com\r\n\r\n", "", ErrNotFound},
+		{"http/2 preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", "", ErrNotFound},
+		{"ssh", "SSH-2.0-OpenSSH_9.6\r\n", "", ErrNotFound},
+		{"binary", "\x00\x01\x02\x03", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := HTTP([]byte(tt.data))
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Fatalf("HTTP() = %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// quicVersion holds the constants that derive Initial packet keys for a QUIC
+// version (RFC 9001, section 5.2; RFC 9369, section 3.3).
+type quicVersion struct {
+	salt        []byte
+	initialType byte // long header packet type of Initial packets
+	keyLabel    string
+	ivLabel     string
+	hpLabel     string
+}
+
+var quicVersions = map[uint32]quicVersion{
+	0x00000001: {
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		initialType: 0x0,
+		keyLabel:    "quic key",
+		ivLabel:     "quic iv",
+		hpLabel:     "quic hp",
+	},
+	0x6b3343cf: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		initialType: 0x1,
+		keyLabel:    "quicv2 key",
+		ivLabel:     "quicv2 iv",
+		hpLabel:     "quicv2 hp",
+	},
+}
+
+const (
+	maxConnectionIDLen = 20
+	sampleLen          = 16
+	maxCryptoOffset    = maxHandshakeLen
+
+	frameTypePadding = 0x00
+	frameTypePing    = 0x01
+	frameTypeAck     = 0x02
+	frameTypeAckECN  = 0x03
+	frameTypeCrypto  = 0x06
+)
+
+// cryptoFragment is the data of a CRYPTO frame at its stream offset.
+type cryptoFragment struct {
+	offset uint64
+	data   []byte
+}
+
+// QUIC returns the server name in the TLS ClientHello carried by the
+// Initial packets of a QUIC connection, given the client's first datagrams
+// in order. Large ClientHellos span several datagrams; ErrIncomplete means
+// the next one is needed.
+func QUIC(datagrams ...[]byte) (string, error) {
+	var fragments []cryptoFragment
+	opened := false
+	for _, datagram := range datagrams {
+		// A datagram can coalesce several packets; only Initial ones are
+		// readable, and they come first
+		for len(datagram) > 0 {
+			payload, rest, ok := openInitial(datagram)
+			if !ok {
+				break
+			}
+			opened = true
+			fragments = appendCryptoFrames(fragments, payload)
+			datagram = rest
+		}
+	}
+	if !opened {
+		return "", ErrNotFound
+	}
+	return clientHelloServerName(assembleCrypto(fragments))
+}
+
+// openInitial removes the protection from the client Initial packet at the
+// start of b and returns its payload and the rest of the datagram.
+func openInitial(b []byte) (payload, rest []byte, ok bool) {
+	// Long header with the fixed bit set
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 {
+		return nil, nil, false
+	}
+	version, known := quicVersions[binary.BigEndian.Uint32(b[1:5])]
+	if !known || (b[0]>>4)&0x3 != version.initialType {
+		return nil, nil, false
+	}
+
+	s := cryptobyte.String(b[5:])
+	var dcid, scid cryptobyte.String
+	var tokenLen, length uint64
+	if !s.ReadUint8LengthPrefixed(&dcid) || len(dcid) > maxConnectionIDLen ||
+		!s.ReadUint8LengthPrefixed(&scid) || len(scid) > maxConnectionIDLen ||
+		!readVarint(&s, &tokenLen) || tokenLen > uint64(len(s)) || !s.Skip(int(tokenLen)) ||
+		!readVarint(&s, &length) {
+		return nil, nil, false
+	}
+	pnOffset := len(b) - len(s)
+	if length < 4+sampleLen || length > uint64(len(s)) {
+		return nil, nil, false
+	}
+	packet, rest := b[:pnOffset+int(length)], b[pnOffset+int(length):]
+
+	aead, hp, iv, err := initialKeys(version, dcid)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	// Remove header protection (RFC 9001, section 5.4) from a copy
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+sampleLen])
+	header := slices.Clone(packet[:pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := range pnLen {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	nonce := slices.Clone(iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err = aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, nil, false
+	}
+	return payload, rest, true
+}
+
+// initialKeys derives the client's Initial packet protection keys from the
+// destination connection ID.
+func initialKeys(version quicVersion, dcid []byte) (cipher.AEAD, cipher.Block, []byte, error) {
+	initialSecret, err := hkdf.Extract(sha256.New, dcid, version.salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	clientSecret, err := expandLabel(initialSecret, "client in", sha256.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := expandLabel(clientSecret, version.keyLabel, 16)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iv, err := expandLabel(clientSecret, version.ivLabel, 12)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hpKey, err := expandLabel(clientSecret, version.hpLabel, 16)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return aead, hp, iv, nil
+}
+
+// expandLabel is HKDF-Expand-Label with an empty context (RFC 8446,
+// section 7.1).
+func expandLabel(secret []byte, label string, length int) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	info, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// appendCryptoFrames appends the CRYPTO frames of an Initial packet's
+// payload. Parsing stops at the first frame type that can't occur before
+// the ClientHello is complete.
+func appendCryptoFrames(fragments []cryptoFragment, payload []byte) []cryptoFragment {
+	s := cryptobyte.String(payload)
+	for !s.Empty() {
+		var frameType uint64
+		if !readVarint(&s, &frameType) {
+			return fragments
+		}
+		switch frameType {
+		case frameTypePadding, frameTypePing:
+		case frameTypeAck, frameTypeAckECN:
+			var largest, delay, rangeCount, firstRange uint64
+			if !readVarint(&s, &largest) || !readVarint(&s, &delay) || !readVarint(&s, &rangeCount) || !readVarint(&s, &firstRange) {
+				return fragments
+			}
+			fields := 2 * rangeCount // gap and length of each range
+			if frameType == frameTypeAckECN {
+				fields += 3
+			}
+			for range fields {
+				var v uint64
+				if !readVarint(&s, &v) {
+					return fragments
+				}
+			}
+		case frameTypeCrypto:
+			var offset, length uint64
+			var data []byte
+			if !readVarint(&s, &offset) || !readVarint(&s, &length) ||
+				offset+length > maxCryptoOffset || !s.ReadBytes(&data, int(length)) {
+				return fragments
+			}
+			fragments = append(fragments, cryptoFragment{offset: offset, data: data})
+		default:
+			return fragments
+		}
+	}
+	return fragments
+}
+
+// assembleCrypto returns the CRYPTO stream data available without gaps from
+// offset 0. Clients may split and reorder the ClientHello across frames.
+func assembleCrypto(fragments []cryptoFragment) []byte {
+	slices.SortFunc(fragments, func(a, b cryptoFragment) int {
+		return int(a.offset) - int(b.offset)
+	})
+	var stream []byte
+	for _, f := range fragments {
+		end := f.offset + uint64(len(f.data))
+		if f.offset > uint64(len(stream)) {
+			break
+		}
+		if end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+	return stream
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000, section 16).
+func readVarint(s *cryptobyte.String, v *uint64) bool {
+	var first uint8
+	if !s.ReadUint8(&first) {
+		return false
+	}
+	n := 1 << (first >> 6)
+	*v = uint64(first & 0x3f)
+	for range n - 1 {
+		var b uint8
+		if !s.ReadUint8(&b) {
+			return false
+		}
+		*v = *v<<8 | uint64(b)
+	}
+	return true
+}
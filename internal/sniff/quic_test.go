@@ -0,0 +1,210 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// rfc9001ClientInitial returns the protected client Initial packet of RFC
+// 9001, Appendix A.2, whose ClientHello names example.com.
+func rfc9001ClientInitial(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/rfc9001_client_initial.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := hex.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// handshakeMessage returns the ClientHello message of a TLS client, without
+// its record header.
+func handshakeMessage(t *testing.T, serverName string) []byte {
+	t.Helper()
+	record := clientHello(t, serverName)
+	n := int(binary.BigEndian.Uint16(record[3:5]))
+	return record[recordHeaderLen : recordHeaderLen+n]
+}
+
+// cryptoFrame encodes a CRYPTO frame with 4-byte varint offset and length.
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{frameTypeCrypto}
+	frame = binary.BigEndian.AppendUint32(frame, 0x80000000|uint32(offset))
+	frame = binary.BigEndian.AppendUint32(frame, 0x80000000|uint32(len(data)))
+	return append(frame, data...)
+}
+
+// sealInitial builds a protected client Initial packet carrying payload.
+func sealInitial(t *testing.T, version uint32, dcid []byte, pn uint32, payload []byte) []byte {
+	t.Helper()
+	v := quicVersions[version]
+	aead, hp, iv, err := initialKeys(v, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Long header with a 4-byte packet number, an empty source connection
+	// ID and no token
+	header := []byte{0xc3 | v.initialType<<4}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0, 0)
+	header = binary.BigEndian.AppendUint16(header, 0x4000|uint16(4+len(payload)+aead.Overhead()))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, pn)
+
+	nonce := append([]byte(nil), iv...)
+	for i := range 4 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := aead.Seal(header, nonce, payload, header)
+
+	mask := make([]byte, 16)
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+sampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	for i := range 4 {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func TestQUICRFC9001(t *testing.T) {
+	packet := rfc9001ClientInitial(t)
+
+	got, err := QUIC(packet)
+	if got != "example.com" || err != nil {
+		t.Fatalf("QUIC() = %q, %v; want example.com", got, err)
+	}
+
+	// Any change to the protected packet fails authentication
+	for _, i := range []int{0, 6, 30, len(packet) - 1} {
+		corrupt := append([]byte(nil), packet...)
+		corrupt[i] ^= 0x01
+		if got, err := QUIC(corrupt); !errors.Is(err, ErrNotFound) {
+			t.Errorf("corrupt byte %d: QUIC() = %q, %v; want ErrNotFound", i, got, err)
+		}
+	}
+
+	if got, err := QUIC(packet[:len(packet)/2]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("truncated packet: QUIC() = %q, %v; want ErrNotFound", got, err)
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	hello := handshakeMessage(t, "www.example.com")
+	dcid := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	first, second := hello[:100], hello[100:]
+	seal := func(pn uint32, frames ...[]byte) []byte {
+		var payload []byte
+		for _, f := range frames {
+			payload = append(payload, f...)
+		}
+		return sealInitial(t, 0x00000001, dcid, pn, payload)
+	}
+	ping, padding := []byte{frameTypePing}, make([]byte, 20)
+	ack := []byte{frameTypeAck, 0x00, 0x00, 0x00, 0x00}
+
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+		want      string
+		err       error
+	}{
+		{
+			name:      "single frame",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, hello))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "other frames",
+			datagrams: [][]byte{seal(0, ping, ack, cryptoFrame(0, hello), padding)},
+			want:      "www.example.com",
+		},
+		{
+			name:      "quic v2",
+			datagrams: [][]byte{sealInitial(t, 0x6b3343cf, dcid, 0, cryptoFrame(0, hello))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "split across frames",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, first), cryptoFrame(100, second))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "out of order frames",
+			datagrams: [][]byte{seal(0, cryptoFrame(100, second), ping, cryptoFrame(0, first))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "overlapping frames",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, hello[:150]), cryptoFrame(50, hello[50:]))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "split across datagrams",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, first)), seal(1, cryptoFrame(100, second))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "out of order datagrams",
+			datagrams: [][]byte{seal(1, cryptoFrame(100, second)), seal(0, cryptoFrame(0, first))},
+			want:      "www.example.com",
+		},
+		{
+			name:      "coalesced packets",
+			datagrams: [][]byte{append(seal(0, cryptoFrame(0, first)), seal(1, cryptoFrame(100, second))...)},
+			want:      "www.example.com",
+		},
+		{
+			name:      "coalesced with an unreadable packet",
+			datagrams: [][]byte{append(seal(0, cryptoFrame(0, hello)), 0x40, 0x01, 0x02, 0x03)},
+			want:      "www.example.com",
+		},
+		{
+			name:      "first part only",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, first))},
+			err:       ErrIncomplete,
+		},
+		{
+			name:      "second part only",
+			datagrams: [][]byte{seal(1, cryptoFrame(100, second))},
+			err:       ErrIncomplete,
+		},
+		{
+			name:      "gap",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, hello[:50]), cryptoFrame(100, second))},
+			err:       ErrIncomplete,
+		},
+		{
+			name:      "short header packet",
+			datagrams: [][]byte{{0x40, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}},
+			err:       ErrNotFound,
+		},
+		{
+			name:      "unknown version",
+			datagrams: [][]byte{append([]byte{0xc3, 0x0a, 0x0a, 0x0a, 0x0a}, make([]byte, 60)...)},
+			err:       ErrNotFound,
+		},
+		{
+			name:      "not a ClientHello",
+			datagrams: [][]byte{seal(0, cryptoFrame(0, []byte{0x02, 0x00, 0x00, 0x01, 0x00}))},
+			err:       ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QUIC(tt.datagrams...)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Fatalf("QUIC() = %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package sniff
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	// ErrIncomplete is returned when the data ends before the server name
+	// could be found; more data may contain it.
+	ErrIncomplete = errors.New("incomplete data")
+
+	// ErrNotFound is returned when the data is not of the sniffed protocol
+	// or carries no server name.
+	ErrNotFound = errors.New("no server name found")
+)
+
+// Stream returns the server name from the first bytes a client sends on a
+// TCP connection: the SNI of a TLS ClientHello or the Host header of an
+// HTTP/1 request.
+func Stream(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", ErrIncomplete
+	}
+	if data[0] == recordTypeHandshake {
+		return TLS(data)
+	}
+	return HTTP(data)
+}
+
+// normalizeName lowercases a server name and strips a trailing dot. It
+// returns "" for IP literals, which say nothing the destination didn't.
+func normalizeName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if net.ParseIP(name) != nil {
+		return ""
+	}
+	return name
+}
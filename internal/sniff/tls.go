@@ -0,0 +1,100 @@
+package sniff
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	recordHeaderLen          = 5
+	maxRecordLen             = 16384 + 2048 // plaintext limit plus expansion (RFC 8446, section 5.2)
+	handshakeTypeClientHello = 0x01
+	maxHandshakeLen          = 1 << 16
+	extensionServerName      = 0x0000
+	serverNameTypeHostName   = 0x00
+)
+
+// TLS returns the server name indication of a TLS ClientHello, which may
+// span several records. Records after the one completing the ClientHello,
+// e.g. a ChangeCipherSpec or early data sent with it, are not looked at.
+func TLS(data []byte) (string, error) {
+	var msg []byte
+	for len(data) >= recordHeaderLen && !handshakeComplete(msg) {
+		if data[0] != recordTypeHandshake || data[1] != 3 {
+			return "", ErrNotFound
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if n == 0 || n > maxRecordLen {
+			return "", ErrNotFound
+		}
+		data = data[recordHeaderLen:]
+		n = min(n, len(data))
+		msg = append(msg, data[:n]...)
+		data = data[n:]
+	}
+	return clientHelloServerName(msg)
+}
+
+// handshakeComplete reports whether msg holds a whole handshake message.
+func handshakeComplete(msg []byte) bool {
+	return len(msg) >= 4 && len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3]))
+}
+
+// clientHelloServerName returns the server name of a ClientHello handshake
+// message (RFC 8446, section 4.1.2; RFC 6066, section 3).
+func clientHelloServerName(msg []byte) (string, error) {
+	if len(msg) < 4 {
+		return "", ErrIncomplete
+	}
+	if msg[0] != handshakeTypeClientHello {
+		return "", ErrNotFound
+	}
+	n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if n > maxHandshakeLen {
+		return "", ErrNotFound
+	}
+	if len(msg) < 4+n {
+		return "", ErrIncomplete
+	}
+
+	s := cryptobyte.String(msg[4 : 4+n])
+	var sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !s.Skip(2+32) || // legacy_version, random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compression) ||
+		!s.ReadUint16LengthPrefixed(&extensions) {
+		return "", ErrNotFound
+	}
+
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return "", ErrNotFound
+		}
+		if extType != extensionServerName {
+			continue
+		}
+
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return "", ErrNotFound
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return "", ErrNotFound
+			}
+			if nameType == serverNameTypeHostName {
+				if host := normalizeName(string(name)); host != "" {
+					return host, nil
+				}
+			}
+		}
+	}
+	return "", ErrNotFound
+}
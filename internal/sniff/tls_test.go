@@ -0,0 +1,71 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first flight of a TLS client for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName})
+		conn.Handshake()
+		client.Close()
+	}()
+
+	buf := make([]byte, 64<<10)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// splitRecords re-frames a single-record handshake into records of at most
+// size bytes.
+func splitRecords(record []byte, size int) []byte {
+	header, body := record[:recordHeaderLen], record[recordHeaderLen:]
+	var out []byte
+	for len(body) > 0 {
+		n := min(size, len(body))
+		out = append(out, header[0], header[1], header[2], byte(n>>8), byte(n))
+		out = append(out, body[:n]...)
+		body = body[n:]
+	}
+	return out
+}
+
+func TestTLS(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	changeCipherSpec := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+	earlyData := []byte{0x17, 0x03, 0x03, 0x00, 0x03, 0xaa, 0xbb, 0xcc}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+		err  error
+	}{
+		{"single record", hello, "www.example.com", nil},
+		{"split records", splitRecords(hello, 100), "www.example.com", nil},
+		{"coalesced change cipher spec", append(append([]byte(nil), hello...), changeCipherSpec...), "www.example.com", nil},
+		{"coalesced early data", append(append(append([]byte(nil), hello...), changeCipherSpec...), earlyData...), "www.example.com", nil},
+		{"truncated", hello[:len(hello)/2], "", ErrIncomplete},
+		{"not handshake", earlyData, "", ErrNotFound},
+		{"interrupted handshake", append(splitRecords(hello, 100)[:105], earlyData...), "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TLS(tt.data)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Fatalf("TLS() = %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}